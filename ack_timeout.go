@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ZoneTargetConfig.OnTimeout values.
+const (
+	TimeoutRetry    = "RETRY"
+	TimeoutEscalate = "ESCALATE"
+)
+
+// defaultAckTimeout applies to zones with no ZoneTargetConfig row for a target.
+const defaultAckTimeout = 15 * time.Minute
+
+// cafSentTargets maps each status that is waiting on a partner ACK to the
+// outbox target it is waiting on.
+var cafSentTargets = map[string]string{
+	StatusPreactSent:     "PREACT",
+	StatusTvSent:         "TV",
+	StatusFinalactSent:   "FINALACT",
+	StatusCommissionSent: "COMMISSION",
+}
+
+// cafTimeoutStatuses maps each outbox target to the CAF status used when its
+// ACK deadline passes.
+var cafTimeoutStatuses = map[string]string{
+	"PREACT":     StatusPreactTimeout,
+	"TV":         StatusTvTimeout,
+	"FINALACT":   StatusFinalactTimeout,
+	"COMMISSION": StatusCommissionTimeout,
+}
+
+// targetConfig returns the zone's settings for target, falling back to the
+// defaults when the zone has none.
+func (s *OnboardingService) targetConfig(zoneCode, target string) ZoneTargetConfig {
+	config := ZoneTargetConfig{
+		ZoneCode:       zoneCode,
+		Target:         target,
+		AckTimeoutSec:  int(defaultAckTimeout / time.Second),
+		OnTimeout:      TimeoutEscalate,
+		MaxAttempts:    defaultMaxAttempts,
+		BackoffBaseSec: int(defaultBackoffBase / time.Second),
+		BackoffMaxSec:  int(defaultBackoffMax / time.Second),
+		MaxRetries:     defaultMaxRetries,
+
+		BreakerWindow:     defaultBreakerWindow,
+		BreakerFailurePct: defaultBreakerFailurePct,
+		BreakerOpenSec:    int(defaultBreakerOpen / time.Second),
+		BreakerProbes:     defaultBreakerProbes,
+	}
+	s.DB.Where("zone_code = ? AND target = ?", zoneCode, target).First(&config)
+	return config
+}
+
+// RunAckTimeoutSweeper calls SweepAckTimeouts every interval until ctx is done.
+func (s *OnboardingService) RunAckTimeoutSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := s.SweepAckTimeouts(now); err != nil {
+				log.Printf("ACK timeout sweep failed: %v", err)
+			}
+		}
+	}
+}
+
+// SweepAckTimeouts moves every CAF whose partner ACK is overdue, and the
+// outbox row it is waiting on, to TIMEOUT. The deadline runs from when the
+// row was sent, so a row still PENDING, for example one held back by its
+// partner's circuit breaker or rate limit, never times out. Each timeout is
+// then retried or escalated according to the zone's OnTimeout setting, and
+// compensated once the step has no retries left.
+func (s *OnboardingService) SweepAckTimeouts(now time.Time) error {
+	sent := make([]string, 0, len(cafSentTargets))
+	for status := range cafSentTargets {
+		sent = append(sent, status)
+	}
+
+	var cafs []Caf
+	if err := s.DB.Where("status IN ?", sent).Find(&cafs).Error; err != nil {
+		return err
+	}
+
+	for _, caf := range cafs {
+		target := cafSentTargets[caf.Status]
+		config := s.targetConfig(caf.ZoneCode, target)
+
+		var outbox IntegrationOutbox
+		err := s.DB.Where("caf_id = ? AND target = ?", caf.ID, target).
+			Order("created_at DESC").
+			First(&outbox).Error
+		if err != nil {
+			log.Printf("ACK timeout: no %s outbox row for CAF %s: %v", target, caf.CafRefNo, err)
+			continue
+		}
+
+		if outbox.Status != "SENT" || outbox.SentAt == nil {
+			continue
+		}
+		deadline := outbox.SentAt.Add(time.Duration(config.AckTimeoutSec) * time.Second)
+		if now.Before(deadline) {
+			continue
+		}
+
+		if err := s.expireAck(caf, outbox, config); err != nil {
+			log.Printf("ACK timeout for CAF %s failed: %v", caf.CafRefNo, err)
+		}
+	}
+	return nil
+}
+
+func (s *OnboardingService) expireAck(caf Caf, outbox IntegrationOutbox, config ZoneTargetConfig) error {
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := s.transition(tx, &caf, cafTimeoutStatuses[outbox.Target]); err != nil {
+			return err
+		}
+		if err := tx.Model(&outbox).Update("status", "TIMEOUT").Error; err != nil {
+			return err
+		}
+		return s.audit(tx, caf, "ACK_TIMEOUT", "", map[string]interface{}{
+			"target":          outbox.Target,
+			"correlation_id":  outbox.CorrelationID,
+			"ack_timeout_sec": config.AckTimeoutSec,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if config.OnTimeout == TimeoutRetry {
+		err := s.RetryStep(caf.CafRefNo, "")
+		if !errors.Is(err, ErrRetryLimitReached) {
+			return err
+		}
+	}
+	if err := s.escalate(caf, outbox); err != nil || len(cafCompensations[caf.Status]) == 0 {
+		return err
+	}
+	// Like a refused ACK, a step with no retries left is compensated
+	return s.inTx(func(s *OnboardingService) error {
+		return s.compensateIfFinal(caf, outbox.Target)
+	})
+}
+
+// escalate leaves a CAF whose outbox request timed out or was refused for an
+// operator to retry or close.
+func (s *OnboardingService) escalate(caf Caf, outbox IntegrationOutbox) error {
+	log.Printf("⚠️ ESCALATION: CAF %s is %s after %s %s", caf.CafRefNo, caf.Status, outbox.Target, outbox.CorrelationID)
+	return s.audit(s.DB, caf, "ESCALATED", "", map[string]interface{}{
+		"target":         outbox.Target,
+		"correlation_id": outbox.CorrelationID,
+	})
+}
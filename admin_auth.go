@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminOperatorKey is the gin context key AdminAuth stores the operator
+// under.
+const adminOperatorKey = "admin_operator"
+
+// AdminAuth requires "Authorization: Bearer <token>" on the admin API.
+// tokens maps each accepted token to the operator it was issued to, which
+// handlers record in the audit trail through adminOperator. With no tokens
+// configured the admin API is disabled rather than left open.
+func AdminAuth(tokens map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(tokens) == 0 {
+			c.AbortWithStatusJSON(503, gin.H{"error": "admin API disabled: ADMIN_TOKENS is not set"})
+			return
+		}
+		got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		operator := ""
+		for token, name := range tokens {
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+				operator = name
+			}
+		}
+		if !ok || operator == "" {
+			c.AbortWithStatusJSON(401, gin.H{"error": "admin token required"})
+			return
+		}
+		c.Set(adminOperatorKey, operator)
+		c.Next()
+	}
+}
+
+// adminOperator returns the operator AdminAuth authenticated the request as.
+func adminOperator(c *gin.Context) string {
+	return c.GetString(adminOperatorKey)
+}
+
+// parseAdminTokens parses a comma-separated list of operator:token pairs.
+func parseAdminTokens(list string) map[string]string {
+	tokens := map[string]string{}
+	for _, pair := range strings.Split(list, ",") {
+		name, token, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && name != "" && token != "" {
+			tokens[token] = name
+		}
+	}
+	return tokens
+}
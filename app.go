@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,25 +13,23 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/segmentio/kafka-go"
 	"go.flowable.io/flowable"
 	"go.flowable.io/flowable/client"
 )
 
 type App struct {
-	db         *pgxpool.Pool
-	flowable   *flowable.Client
-	httpServer *http.Server
+	db           *pgxpool.Pool
+	flowable     *flowable.Client
+	httpServer   *http.Server
+	stopConsumer context.CancelFunc
+	consumerDone chan struct{}
 }
 
-type KafkaMessage struct {
-	ID        string                 `json:"message_id"`
-	PlanCode  string                 `json:"plan_code"`
-	IMSI      string                 `json:"imsi"`
-	Customer  map[string]interface{} `json:"customer"`
-	AgentHRNO string                 `json:"pos_agent_hrno"`
-	CSCHRNO   string                 `json:"csc_hrno"`
-}
+// KafkaMessage is the CAF message shared with the main.go consumer.
+type KafkaMessage = CAFMessage
 
 func main() {
 	app := &App{}
@@ -52,7 +51,10 @@ func main() {
 	}
 	app.flowable = flowableClient
 
-	// Deploy BPMN Process
+	// Deploy BPMN Process. Its wait tasks are deployed as delegateExpression
+	// wait states, which the partner callbacks complete with
+	// Executions.Trigger; main.go deploys the same file with every service
+	// task done by its external workers instead (externalWorkerBPMN).
 	_, err = app.flowable.Repository.Deployments.Create(&flowable.DeploymentCreate{
 		Name: "Customer Onboarding Workflow",
 		Files: map[string][]byte{
@@ -72,8 +74,12 @@ func main() {
 		Handler: r,
 	}
 
-	// Start Kafka Consumer (simplified)
-	go app.startKafkaConsumer()
+	// Start Kafka Consumer
+	consumerCtx, stopConsumer := context.WithCancel(context.Background())
+	app.stopConsumer = stopConsumer
+	app.consumerDone = make(chan struct{})
+	go app.startKafkaConsumer(consumerCtx)
+	go RunIdempotencyCleanup(consumerCtx, pgxIdempotencyStore{db: app.db}, defaultIdempotencyTTL, time.Hour)
 
 	// Start Server
 	go func() {
@@ -90,6 +96,8 @@ func main() {
 }
 
 func (app *App) setupRoutes(r *gin.Engine) {
+	r.Use(IdempotencyMiddleware(pgxIdempotencyStore{db: app.db}))
+
 	kafkaGroup := r.Group("/kafka")
 	{
 		kafkaGroup.POST("/caf", app.handleCAFRecord)
@@ -106,86 +114,118 @@ func (app *App) setupRoutes(r *gin.Engine) {
 	r.GET("/status/:cafId", app.getCAFStatus)
 }
 
+// errDuplicateMessage is returned by ingestCAF for a message_id that has
+// already been ingested, through either Kafka or POST /kafka/caf.
+var errDuplicateMessage = errors.New("CAF message already processed")
+
 func (app *App) handleCAFRecord(c *gin.Context) {
-	var msg KafkaMessage
-	if err := c.ShouldBindJSON(&msg); err != nil {
+	body, err := c.GetRawData()
+	if err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	msg, err := parseKafkaMessage(body)
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		c.JSON(400, gin.H{"error": "invalid CAF message", "fields": verr.Fields})
+		return
+	}
 
 	// Step 1: Save to CAF Table and Start Workflow
-	cafID, err := app.saveCAFRecord(msg)
+	cafID, processID, err := app.ingestCAF(c.Request.Context(), msg)
+	if errors.Is(err, errDuplicateMessage) {
+		c.JSON(409, gin.H{"error": err.Error(), "caf_id": cafID, "process_id": processID})
+		return
+	}
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
+	c.JSON(200, gin.H{
+		"message":    "CAF processed and workflow started",
+		"caf_id":     cafID,
+		"process_id": processID,
+	})
+}
+
+// parseKafkaMessage parses and validates a CAF message. This variant keys
+// CAFs on message_id, so it is required.
+func parseKafkaMessage(data []byte) (KafkaMessage, error) {
+	msg, err := ParseCAFMessage(data)
+	if err == nil && msg.MessageID == "" {
+		err = &ValidationError{Fields: []FieldError{{Field: "message_id", Message: "required"}}}
+	}
+	return msg, err
+}
+
+// ingestCAF saves a CAF message and starts its process, with message_id as
+// the business key. A message_id seen before returns errDuplicateMessage,
+// unless its process never started, in which case it is started now.
+func (app *App) ingestCAF(ctx context.Context, msg KafkaMessage) (int, string, error) {
+	cafID, created, err := app.saveCAFRecord(ctx, msg)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if !created {
+		instances, err := app.flowable.Engine.ProcessInstances.List(&flowable.ProcessInstanceQuery{
+			ProcessDefinitionKey: "customerOnboardingProcess",
+			BusinessKey:          msg.MessageID,
+		})
+		if err != nil {
+			return cafID, "", err
+		}
+		if len(instances) > 0 {
+			return cafID, instances[0].ID, errDuplicateMessage
+		}
+	}
+
 	// Start Flowable Process
 	processInstance, err := app.flowable.Engine.ProcessInstances.Create(&flowable.StartProcessInstance{
 		ProcessDefinitionKey: "customerOnboardingProcess",
+		BusinessKey:          msg.MessageID,
 		Variables: []flowable.Variable{
 			{Name: "cafId", Value: strconv.Itoa(cafID)},
-			{Name: "kafkaMessageId", Value: msg.ID},
+			{Name: "kafkaMessageId", Value: msg.MessageID},
 		},
 	})
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to start workflow"})
-		return
+		return cafID, "", fmt.Errorf("failed to start workflow: %w", err)
 	}
-
-	c.JSON(200, gin.H{
-		"message":    "CAF processed and workflow started",
-		"caf_id":     cafID,
-		"process_id": processInstance.ID,
-	})
+	return cafID, processInstance.ID, nil
 }
 
-func (app *App) saveCAFRecord(msg KafkaMessage) (int, error) {
-	// Determine Zone
-	zoneCode, err := app.getZoneCode(msg.AgentHRNO)
-	if err != nil {
-		zoneCode = "NORTH" // Default
-	}
+// saveCAFRecord inserts the CAF, or finds the one already inserted for
+// msg.MessageID. created reports which.
+func (app *App) saveCAFRecord(ctx context.Context, msg KafkaMessage) (cafID int, created bool, err error) {
+	// Validate has already filled in the zone from the agent's HRNO if the
+	// message had none
+	zoneCode := msg.ZoneCode
 
-	// Validate Plan Code and get IMSI
+	// USIM plans get their permanent IMSI from PyIOTA
 	imsi := msg.IMSI
-	if app.isUSIMPlan(msg.PlanCode) {
+	if msg.IsUSIM() {
 		imsi = app.fetchPermanentIMSI(msg.IMSI) // PyIOTA API call simulation
 	}
 
-	var cafID int
-	err = app.db.QueryRow(context.Background(),
+	err = app.db.QueryRow(ctx,
 		`INSERT INTO onboarding.caf (kafka_message_id, plan_code, imsi, permanent_imsi, pos_agent_hrno, csc_hrno, zone_code, customer_name, customer_phone, request_data, status)
          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 'VALIDATED')
+         ON CONFLICT (kafka_message_id) DO NOTHING
          RETURNING id`,
-		msg.ID, msg.PlanCode, msg.IMSI, imsi, msg.AgentHRNO, msg.CSCHRNO, zoneCode,
+		msg.MessageID, msg.PlanCode, msg.IMSI, imsi, msg.PosHrno, msg.CSCHrno, zoneCode,
 		msg.Customer["name"], msg.Customer["phone"], msg.Customer).Scan(&cafID)
-
-	return cafID, err
-}
-
-func (app *App) getZoneCode(hrno string) (string, error) {
-	// Zone mapping logic - simplified
-	zoneMap := map[string]string{
-		"HR001": "NORTH",
-		"HR002": "SOUTH",
-		"HR003": "EAST",
-		"HR004": "WEST",
+	if err == nil {
+		return cafID, true, nil
 	}
-	if zone, exists := zoneMap[hrno]; exists {
-		return zone, nil
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, err
 	}
-	return "NORTH", nil
-}
 
-func (app *App) isUSIMPlan(planCode string) bool {
-	usimPlans := []string{"USIM001", "USIM002", "USIM003"}
-	for _, plan := range usimPlans {
-		if plan == planCode {
-			return true
-		}
-	}
-	return false
+	err = app.db.QueryRow(ctx,
+		"SELECT id FROM onboarding.caf WHERE kafka_message_id = $1", msg.MessageID).Scan(&cafID)
+	return cafID, false, err
 }
 
 func (app *App) fetchPermanentIMSI(imsi string) string {
@@ -193,38 +233,173 @@ func (app *App) fetchPermanentIMSI(imsi string) string {
 	return "460001234567890" // Mock permanent IMSI
 }
 
+var (
+	errCAFNotFound  = errors.New("CAF not found")
+	errCAFCompleted = errors.New("CAF has already completed this step")
+)
+
+// callbackSteps describes, per callback statusType, the status table it is
+// recorded in, the onboarding.caf status a SUCCESS moves the CAF to, and the
+// BPMN activity waiting on it ("" when the process does not wait).
+var callbackSteps = map[string]struct {
+	table      string
+	cafStatus  string
+	activityID string
+	resultVar  string
+}{
+	"pre_activation":   {"onboarding.pre_activation_status", "PRE_ACTIVATED", "waitPreActivationAck", "preAckResult"},
+	"televerification": {"onboarding.televerification_status", "TELE_VERIFIED", "waitTeleVerAck", "teleAckResult"},
+	"final_activation": {"onboarding.final_activation_status", "ACTIVATED", "waitFinalAck", "finalAckResult"},
+	"commission":       {"onboarding.commission_status", "COMPLETED", "", "commissionResult"},
+}
+
 func (app *App) handlePreActivationCallback(c *gin.Context) {
-	cafIDStr := c.Param("cafId")
-	cafID, _ := strconv.Atoi(cafIDStr)
+	app.handleStatusCallback(c, "pre_activation")
+}
+
+func (app *App) handleTeleVerificationCallback(c *gin.Context) {
+	app.handleStatusCallback(c, "televerification")
+}
+
+func (app *App) handleFinalActivationCallback(c *gin.Context) {
+	app.handleStatusCallback(c, "final_activation")
+}
+
+func (app *App) handleCommissionCallback(c *gin.Context) {
+	app.handleStatusCallback(c, "commission")
+}
+
+func (app *App) handleStatusCallback(c *gin.Context, statusType string) {
+	cafID, err := strconv.Atoi(c.Param("cafId"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid cafId"})
+		return
+	}
 
 	var status struct {
-		Status string                 `json:"status"`
+		Status string                 `json:"status" binding:"required,oneof=PENDING SUCCESS FAILED"`
 		Data   map[string]interface{} `json:"data"`
 	}
-	c.ShouldBindJSON(&status)
+	if err := c.ShouldBindJSON(&status); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
 
 	// Update status and signal Flowable task
-	app.updateStatusAndSignal(cafID, "pre_activation", status.Status, status.Data)
+	err = app.updateStatusAndSignal(cafID, statusType, status.Status, status.Data)
+	switch {
+	case errors.Is(err, errCAFNotFound):
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errCAFCompleted):
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
 
 	c.JSON(200, gin.H{"message": "Callback processed"})
 }
 
-// Similar handlers for other callbacks...
-func (app *App) handleTeleVerificationCallback(c *gin.Context) {
-	// Implementation similar to pre-activation
-}
+// updateStatusAndSignal records a partner callback in the step's status
+// table, moves onboarding.caf to the matching status and, once the step has
+// a final outcome, triggers the execution waiting on it. Repeating the
+// outcome already recorded only triggers again.
+func (app *App) updateStatusAndSignal(cafID int, statusType, status string, data map[string]interface{}) error {
+	step, ok := callbackSteps[statusType]
+	if !ok {
+		return fmt.Errorf("unknown callback type %q", statusType)
+	}
+	ctx := context.Background()
 
-func (app *App) handleFinalActivationCallback(c *gin.Context) {
-	// Implementation similar to pre-activation
-}
+	tx, err := app.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
 
-func (app *App) handleCommissionCallback(c *gin.Context) {
-	// Implementation similar to pre-activation
-}
+	var cafStatus string
+	err = tx.QueryRow(ctx, "SELECT status FROM onboarding.caf WHERE id = $1 FOR UPDATE", cafID).Scan(&cafStatus)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errCAFNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var recorded string
+	err = tx.QueryRow(ctx,
+		"SELECT status FROM "+step.table+" WHERE caf_id = $1 AND status <> 'PENDING' LIMIT 1", cafID).Scan(&recorded)
+	switch {
+	case err == nil && recorded == status:
+		// A repeat of the recorded outcome, possibly after its trigger
+		// failed: trigger again if the execution is still waiting
+		tx.Rollback(ctx)
+		return app.signalCallback(cafID, statusType, status, data, true)
+	case err == nil:
+		return fmt.Errorf("%w: %s already recorded as %s", errCAFCompleted, statusType, recorded)
+	case !errors.Is(err, pgx.ErrNoRows):
+		return err
+	}
+	if cafStatus == "FAILED" || cafStatus == "REJECTED" {
+		return fmt.Errorf("%w: CAF is %s", errCAFCompleted, cafStatus)
+	}
 
-func (app *App) updateStatusAndSignal(cafID int, statusType, status string, data map[string]interface{}) {
 	// Update respective status table
-	// Signal Flowable task to continue
+	if _, err := tx.Exec(ctx,
+		"INSERT INTO "+step.table+" (caf_id, status, response_data) VALUES ($1, $2, $3)",
+		cafID, status, data); err != nil {
+		return err
+	}
+	if status == "PENDING" {
+		return tx.Commit(ctx)
+	}
+
+	newStatus := step.cafStatus
+	if status == "FAILED" {
+		newStatus = "FAILED"
+	}
+	if _, err := tx.Exec(ctx,
+		"UPDATE onboarding.caf SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		newStatus, cafID); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	return app.signalCallback(cafID, statusType, status, data, false)
+}
+
+// signalCallback triggers the execution of the CAF waiting on a recorded
+// callback's step. A callback that fails here is recorded already; the
+// partner's retry is a repeat, which triggers again while the execution
+// still waits and is refused once it has moved on.
+func (app *App) signalCallback(cafID int, statusType, status string, data map[string]interface{}, repeat bool) error {
+	step := callbackSteps[statusType]
+	if step.activityID == "" {
+		if repeat {
+			return fmt.Errorf("%w: %s already recorded", errCAFCompleted, statusType)
+		}
+		return nil
+	}
+	executions, err := app.flowable.Engine.Executions.List(&flowable.ExecutionQuery{
+		ProcessDefinitionKey: "customerOnboardingProcess",
+		ActivityID:           step.activityID,
+		ProcessVariables:     []flowable.Variable{{Name: "cafId", Value: strconv.Itoa(cafID)}},
+	})
+	if err != nil {
+		return fmt.Errorf("callback recorded but Flowable lookup failed: %w", err)
+	}
+	if len(executions) == 0 {
+		if repeat {
+			return fmt.Errorf("%w: %s already recorded", errCAFCompleted, statusType)
+		}
+		return fmt.Errorf("callback recorded but no execution of CAF %d waits at %s", cafID, step.activityID)
+	}
+	return app.flowable.Engine.Executions.Trigger(executions[0].ID, []flowable.Variable{
+		{Name: step.resultVar, Value: map[string]interface{}{"status": status, "data": data}},
+	})
 }
 
 func (app *App) getCAFStatus(c *gin.Context) {
@@ -245,20 +420,160 @@ func (app *App) getCAFStatus(c *gin.Context) {
 	c.JSON(200, caf)
 }
 
-func (app *App) startKafkaConsumer() {
-	// Simplified Kafka consumer simulation
+// startKafkaConsumer ingests CAF messages from caf-topic until ctx is done.
+// Offsets are committed once a message is ingested, found to be a
+// duplicate, or quarantined as invalid; other failures are retried.
+func (app *App) startKafkaConsumer(ctx context.Context) {
+	defer close(app.consumerDone)
+
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  []string{"localhost:9092"},
+		Topic:    "caf-topic",
+		GroupID:  "caf-flowable-group",
+		MinBytes: 10e3,
+		MaxBytes: 10e6,
+	})
+	defer r.Close()
+
 	for {
-		time.Sleep(10 * time.Second)
-		// Consume from Kafka topic "caf-topic"
-		fmt.Println("Consuming Kafka messages...")
+		m, err := r.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("Kafka error:", err)
+			continue
+		}
+
+		if !app.consumeCAFRecord(ctx, m) {
+			return
+		}
+		if err := r.CommitMessages(context.Background(), m); err != nil {
+			log.Printf("Kafka commit failed (partition %d, offset %d): %v", m.Partition, m.Offset, err)
+		}
+	}
+}
+
+// consumeCAFRecord runs one record through ingestCAF, retrying failures
+// other than invalid and duplicate messages. Invalid messages go to
+// onboarding.caf_quarantine, like the main.go consumer's. It returns false
+// if ctx ends before the record is handled.
+func (app *App) consumeCAFRecord(ctx context.Context, m kafka.Message) bool {
+	msg, err := parseKafkaMessage(m.Value)
+	if err != nil {
+		log.Printf("Quarantining CAF message (partition %d, offset %d): %v", m.Partition, m.Offset, err)
+		for {
+			qerr := app.quarantineCAFRecord(m, err)
+			if qerr == nil {
+				return true
+			}
+			log.Printf("Quarantining CAF message (partition %d, offset %d) failed, retrying: %v", m.Partition, m.Offset, qerr)
+			if !waitRetry(ctx) {
+				return false
+			}
+		}
+	}
+
+	for {
+		cafID, processID, err := app.ingestCAF(ctx, msg)
+		switch {
+		case err == nil:
+			log.Printf("CAF %d ingested from Kafka, process %s", cafID, processID)
+			return true
+		case errors.Is(err, errDuplicateMessage):
+			log.Printf("Skipping duplicate CAF message %s (CAF %d)", msg.MessageID, cafID)
+			return true
+		}
+
+		log.Printf("CAF message %s failed, retrying: %v", msg.MessageID, err)
+		if !waitRetry(ctx) {
+			return false
+		}
+	}
+}
+
+// waitRetry waits before a failed record is tried again. It returns false
+// if ctx ends first.
+func waitRetry(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(5 * time.Second):
+		return true
 	}
 }
 
+// quarantineCAFRecord records a message that failed validation in
+// onboarding.caf_quarantine, bumping its attempts if it is redelivered.
+func (app *App) quarantineCAFRecord(m kafka.Message, cause error) error {
+	_, err := app.db.Exec(context.Background(),
+		`INSERT INTO onboarding.caf_quarantine (kafka_topic, kafka_partition, kafka_offset, key, payload, error)
+         VALUES ($1, $2, $3, $4, $5, $6)
+         ON CONFLICT (kafka_topic, kafka_partition, kafka_offset)
+         DO UPDATE SET error = EXCLUDED.error, attempts = caf_quarantine.attempts + 1, updated_at = CURRENT_TIMESTAMP`,
+		m.Topic, m.Partition, m.Offset, string(m.Key), string(m.Value), cause.Error())
+	return err
+}
+
+// pgxIdempotencyStore is an IdempotencyStore on onboarding.idempotency_keys.
+type pgxIdempotencyStore struct {
+	db *pgxpool.Pool
+}
+
+func (s pgxIdempotencyStore) Begin(ctx context.Context, rec IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	tag, err := s.db.Exec(ctx,
+		`INSERT INTO onboarding.idempotency_keys (key, method, path, request_hash)
+         VALUES ($1, $2, $3, $4)
+         ON CONFLICT (key, method, path) DO NOTHING`,
+		rec.Key, rec.Method, rec.Path, rec.RequestHash)
+	if err != nil {
+		return rec, false, err
+	}
+	if tag.RowsAffected() == 1 {
+		return rec, true, nil
+	}
+
+	var existing IdempotencyRecord
+	err = s.db.QueryRow(ctx,
+		`SELECT key, method, path, request_hash, status_code, content_type, body, created_at, updated_at
+         FROM onboarding.idempotency_keys WHERE key = $1 AND method = $2 AND path = $3`,
+		rec.Key, rec.Method, rec.Path).Scan(
+		&existing.Key, &existing.Method, &existing.Path, &existing.RequestHash,
+		&existing.StatusCode, &existing.ContentType, &existing.Body, &existing.CreatedAt, &existing.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Released between the insert and the read
+		return s.Begin(ctx, rec)
+	}
+	return existing, false, err
+}
+
+func (s pgxIdempotencyStore) Complete(ctx context.Context, rec IdempotencyRecord, status int, contentType string, body []byte) error {
+	_, err := s.db.Exec(ctx,
+		`UPDATE onboarding.idempotency_keys
+         SET status_code = $4, content_type = $5, body = $6, updated_at = CURRENT_TIMESTAMP
+         WHERE key = $1 AND method = $2 AND path = $3`, rec.Key, rec.Method, rec.Path, status, contentType, body)
+	return err
+}
+
+func (s pgxIdempotencyStore) Release(ctx context.Context, rec IdempotencyRecord) error {
+	_, err := s.db.Exec(ctx,
+		"DELETE FROM onboarding.idempotency_keys WHERE key = $1 AND method = $2 AND path = $3 AND status_code = 0",
+		rec.Key, rec.Method, rec.Path)
+	return err
+}
+
+func (s pgxIdempotencyStore) Expire(ctx context.Context, cutoff time.Time) (int64, error) {
+	tag, err := s.db.Exec(ctx, "DELETE FROM onboarding.idempotency_keys WHERE created_at < $1", cutoff)
+	return tag.RowsAffected(), err
+}
+
 func (app *App) shutdown() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	app.httpServer.Shutdown(ctx)
+	app.stopConsumer()
+	<-app.consumerDone
 	app.db.Close()
 	fmt.Println("Server gracefully shutdown")
 }
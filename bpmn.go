@@ -0,0 +1,260 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// bpmnXML is the process definition the service runs, kept in
+// flowable-bpmn.xml so the same file can be deployed to Flowable.
+//
+//go:embed flowable-bpmn.xml
+var bpmnXML string
+
+// FlowNode kinds supported by the in-process engine.
+const (
+	NodeStartEvent  = "startEvent"
+	NodeServiceTask = "serviceTask"
+	NodeUserTask    = "userTask"
+	NodeEndEvent    = "endEvent"
+)
+
+type bpmnDefinitions struct {
+	Processes []bpmnProcess `xml:"http://www.omg.org/spec/BPMN/20100524/MODEL process"`
+}
+
+type bpmnProcess struct {
+	ID           string             `xml:"id,attr"`
+	Name         string             `xml:"name,attr"`
+	StartEvents  []bpmnActivity     `xml:"http://www.omg.org/spec/BPMN/20100524/MODEL startEvent"`
+	ServiceTasks []bpmnActivity     `xml:"http://www.omg.org/spec/BPMN/20100524/MODEL serviceTask"`
+	UserTasks    []bpmnActivity     `xml:"http://www.omg.org/spec/BPMN/20100524/MODEL userTask"`
+	EndEvents    []bpmnActivity     `xml:"http://www.omg.org/spec/BPMN/20100524/MODEL endEvent"`
+	Flows        []bpmnSequenceFlow `xml:"http://www.omg.org/spec/BPMN/20100524/MODEL sequenceFlow"`
+}
+
+type bpmnActivity struct {
+	ID                 string              `xml:"id,attr"`
+	Name               string              `xml:"name,attr"`
+	DelegateExpression string              `xml:"http://flowable.org/bpmn delegateExpression,attr"`
+	Extensions         *bpmnExtensionElems `xml:"http://www.omg.org/spec/BPMN/20100524/MODEL extensionElements"`
+}
+
+type bpmnExtensionElems struct {
+	Fields []bpmnField `xml:"http://flowable.org/bpmn field"`
+}
+
+type bpmnField struct {
+	Name        string `xml:"name,attr"`
+	StringValue string `xml:"stringValue,attr"`
+}
+
+type bpmnSequenceFlow struct {
+	ID        string `xml:"id,attr"`
+	SourceRef string `xml:"sourceRef,attr"`
+	TargetRef string `xml:"targetRef,attr"`
+	Condition string `xml:"http://www.omg.org/spec/BPMN/20100524/MODEL conditionExpression"`
+}
+
+// ProcessDefinition is a parsed, validated BPMN process.
+type ProcessDefinition struct {
+	Key      string
+	Name     string
+	StartID  string
+	Nodes    map[string]*FlowNode
+	Outgoing map[string][]SequenceFlow
+}
+
+// FlowNode is one activity or event of a ProcessDefinition.
+type FlowNode struct {
+	ID       string
+	Name     string
+	Kind     string
+	Delegate string            // delegateExpression with ${...} stripped
+	Fields   map[string]string // flowable:field name -> stringValue
+}
+
+// SequenceFlow is an outgoing edge of a FlowNode. Condition is nil for an
+// unconditional flow.
+type SequenceFlow struct {
+	ID        string
+	Target    string
+	Condition *Condition
+}
+
+// Condition is a parsed conditionExpression of the form
+// ${path == 'value'} or ${path != 'value'}, where path may use dots to
+// reach into map variables.
+type Condition struct {
+	Expr   string
+	Path   []string
+	Negate bool
+	Value  string
+}
+
+// ParseProcessDefinition parses the process with id key out of a BPMN
+// document. Only the subset used by flowable-bpmn.xml is supported: start
+// and end events, service tasks with a delegateExpression, user tasks and
+// sequence flows with optional equality conditions.
+func ParseProcessDefinition(data []byte, key string) (*ProcessDefinition, error) {
+	var defs bpmnDefinitions
+	if err := xml.Unmarshal(data, &defs); err != nil {
+		return nil, fmt.Errorf("parse BPMN: %w", err)
+	}
+
+	var proc *bpmnProcess
+	for i := range defs.Processes {
+		if defs.Processes[i].ID == key {
+			proc = &defs.Processes[i]
+		}
+	}
+	if proc == nil {
+		return nil, fmt.Errorf("BPMN process %q not found", key)
+	}
+
+	def := &ProcessDefinition{
+		Key:      proc.ID,
+		Name:     proc.Name,
+		Nodes:    map[string]*FlowNode{},
+		Outgoing: map[string][]SequenceFlow{},
+	}
+
+	add := func(kind string, activities []bpmnActivity) error {
+		for _, a := range activities {
+			if _, dup := def.Nodes[a.ID]; dup {
+				return fmt.Errorf("BPMN element %q declared twice", a.ID)
+			}
+			node := &FlowNode{ID: a.ID, Name: a.Name, Kind: kind, Fields: map[string]string{}}
+			if a.Extensions != nil {
+				for _, f := range a.Extensions.Fields {
+					node.Fields[f.Name] = f.StringValue
+				}
+			}
+			if kind == NodeServiceTask {
+				expr := strings.TrimSpace(a.DelegateExpression)
+				if !strings.HasPrefix(expr, "${") || !strings.HasSuffix(expr, "}") {
+					return fmt.Errorf("service task %q: unsupported delegateExpression %q", a.ID, a.DelegateExpression)
+				}
+				node.Delegate = strings.TrimSpace(expr[2 : len(expr)-1])
+			}
+			def.Nodes[a.ID] = node
+		}
+		return nil
+	}
+	for kind, activities := range map[string][]bpmnActivity{
+		NodeStartEvent:  proc.StartEvents,
+		NodeServiceTask: proc.ServiceTasks,
+		NodeUserTask:    proc.UserTasks,
+		NodeEndEvent:    proc.EndEvents,
+	} {
+		if err := add(kind, activities); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(proc.StartEvents) != 1 {
+		return nil, fmt.Errorf("BPMN process %q must have exactly one start event", key)
+	}
+	def.StartID = proc.StartEvents[0].ID
+
+	for _, f := range proc.Flows {
+		if def.Nodes[f.SourceRef] == nil || def.Nodes[f.TargetRef] == nil {
+			return nil, fmt.Errorf("sequence flow %q: unknown or unsupported source/target", f.ID)
+		}
+		flow := SequenceFlow{ID: f.ID, Target: f.TargetRef}
+		if expr := strings.TrimSpace(f.Condition); expr != "" {
+			cond, err := parseCondition(expr)
+			if err != nil {
+				return nil, fmt.Errorf("sequence flow %q: %w", f.ID, err)
+			}
+			flow.Condition = cond
+		}
+		def.Outgoing[f.SourceRef] = append(def.Outgoing[f.SourceRef], flow)
+	}
+
+	for id, node := range def.Nodes {
+		if node.Kind != NodeEndEvent && len(def.Outgoing[id]) == 0 {
+			return nil, fmt.Errorf("BPMN element %q has no outgoing sequence flow", id)
+		}
+	}
+	return def, nil
+}
+
+// next picks the first outgoing flow of node whose condition holds. With
+// conditionalOnly, unconditional flows are skipped.
+func (d *ProcessDefinition) next(node *FlowNode, vars map[string]interface{}, conditionalOnly bool) (string, bool) {
+	for _, flow := range d.Outgoing[node.ID] {
+		if flow.Condition == nil {
+			if conditionalOnly {
+				continue
+			}
+			return flow.Target, true
+		}
+		if flow.Condition.Eval(vars) {
+			return flow.Target, true
+		}
+	}
+	return "", false
+}
+
+// activity returns the node whose id or operation field is key.
+func (d *ProcessDefinition) activity(key string) *FlowNode {
+	if node := d.Nodes[key]; node != nil {
+		return node
+	}
+	for _, node := range d.Nodes {
+		if node.Fields["operation"] == key {
+			return node
+		}
+	}
+	return nil
+}
+
+func parseCondition(expr string) (*Condition, error) {
+	if !strings.HasPrefix(expr, "${") || !strings.HasSuffix(expr, "}") {
+		return nil, fmt.Errorf("unsupported condition %q", expr)
+	}
+	body := strings.TrimSpace(expr[2 : len(expr)-1])
+
+	cond := &Condition{Expr: expr}
+	op := "=="
+	if strings.Contains(body, "!=") {
+		op = "!="
+		cond.Negate = true
+	}
+	parts := strings.SplitN(body, op, 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("unsupported condition %q", expr)
+	}
+
+	path := strings.TrimSpace(parts[0])
+	value := strings.TrimSpace(parts[1])
+	if len(value) < 2 || (value[0] != '\'' && value[0] != '"') || value[len(value)-1] != value[0] {
+		return nil, fmt.Errorf("condition %q must compare against a quoted string", expr)
+	}
+	cond.Path = strings.Split(path, ".")
+	cond.Value = value[1 : len(value)-1]
+	return cond, nil
+}
+
+// Eval evaluates the condition against process variables. A path that does
+// not resolve compares as the empty string.
+func (c *Condition) Eval(vars map[string]interface{}) bool {
+	var current interface{} = vars
+	for _, key := range c.Path {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			current = nil
+			break
+		}
+		current = m[key]
+	}
+
+	actual := ""
+	if current != nil {
+		actual = fmt.Sprint(current)
+	}
+	return (actual == c.Value) != c.Negate
+}
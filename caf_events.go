@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"gorm.io/gorm"
+)
+
+// cafEventSchemaVersion is the version of CafEventV1 carried in every
+// event. Bump it, and add a new struct, for any incompatible change.
+const cafEventSchemaVersion = 1
+
+// cafEventTypes names the events downstream teams subscribe to. Any other
+// status change is published as caf.status_changed.
+var cafEventTypes = map[string]string{
+	StatusApproved:     "caf.approved",
+	StatusRejected:     "caf.rejected",
+	StatusFinalactDone: "caf.activated",
+	StatusCompleted:    "caf.completed",
+	StatusCancelled:    "caf.cancelled",
+	StatusRolledBack:   "caf.rolled_back",
+	StatusFailed:       "caf.failed",
+}
+
+// CafEventV1 is the JSON value of a caf-events record.
+type CafEventV1 struct {
+	SchemaVersion int       `json:"schema_version"`
+	EventID       string    `json:"event_id"`
+	EventType     string    `json:"event_type"`
+	CafRefNo      string    `json:"caf_ref_no"`
+	FromStatus    string    `json:"from_status"`
+	ToStatus      string    `json:"to_status"`
+	Step          int       `json:"step"`
+	ZoneCode      string    `json:"zone_code"`
+	IsAgent       bool      `json:"is_agent"`
+	OccurredAt    time.Time `json:"occurred_at"`
+}
+
+// CafEvent is an event outbox row, written in the transaction of the
+// status change it records and published later by RunEventRelay.
+type CafEvent struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	EventID        string     `gorm:"unique" json:"event_id"`
+	CafRefNo       string     `gorm:"index" json:"caf_ref_no"`
+	EventType      string     `json:"event_type"`
+	SchemaVersion  int        `json:"schema_version"`
+	Payload        string     `json:"payload"`
+	PublishedAt    *time.Time `gorm:"index" json:"published_at,omitempty"`
+	Attempts       int        `json:"attempts"`
+	LastError      string     `json:"last_error,omitempty"`
+	LeaseOwner     string     `json:"lease_owner,omitempty"` // relay publishing the event
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// eventLease is how long a relay may spend publishing the events it
+// claimed. Its Kafka write is abandoned after half of it, so the events are
+// not claimed by another relay while the write can still land.
+const eventLease = 30 * time.Second
+
+// recordTransition adds the event for caf moving from -> caf.Status to the
+// outbox inside tx.
+func recordTransition(tx *gorm.DB, caf *Caf, from string) error {
+	eventType := cafEventTypes[caf.Status]
+	if eventType == "" {
+		eventType = "caf.status_changed"
+	}
+
+	now := time.Now().UTC()
+	event := CafEventV1{
+		SchemaVersion: cafEventSchemaVersion,
+		EventID:       fmt.Sprintf("EVT-%s-%d", caf.CafRefNo, now.UnixNano()),
+		EventType:     eventType,
+		CafRefNo:      caf.CafRefNo,
+		FromStatus:    from,
+		ToStatus:      caf.Status,
+		Step:          caf.CurrentStep,
+		ZoneCode:      caf.ZoneCode,
+		IsAgent:       caf.IsAgent,
+		OccurredAt:    now,
+	}
+	payload, _ := json.Marshal(event)
+
+	return tx.Create(&CafEvent{
+		EventID:       event.EventID,
+		CafRefNo:      event.CafRefNo,
+		EventType:     event.EventType,
+		SchemaVersion: event.SchemaVersion,
+		Payload:       string(payload),
+	}).Error
+}
+
+// RunEventRelay publishes unpublished CafEvents every interval until ctx is
+// done.
+func (s *OnboardingService) RunEventRelay(ctx context.Context, w *kafka.Writer, interval time.Duration) {
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.RelayEvents(ctx, w, owner, 100); err != nil {
+				log.Printf("Event relay failed: %v", err)
+			}
+		}
+	}
+}
+
+// RelayEvents publishes up to limit unpublished events in the order they
+// were recorded, keyed by caf_ref_no so each CAF's events stay in order on
+// one partition. Relays on several instances share the work by CAF: see
+// claimEvents. No transaction is held while publishing.
+func (s *OnboardingService) RelayEvents(ctx context.Context, w *kafka.Writer, owner string, limit int) (int, error) {
+	events, err := s.claimEvents(ctx, owner, limit)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+
+	msgs := make([]kafka.Message, len(events))
+	ids := make([]uint, len(events))
+	for i, e := range events {
+		ids[i] = e.ID
+		msgs[i] = kafka.Message{
+			Key:   []byte(e.CafRefNo),
+			Value: []byte(e.Payload),
+			Headers: []kafka.Header{
+				{Key: "event_type", Value: []byte(e.EventType)},
+				{Key: "schema_version", Value: []byte(strconv.Itoa(e.SchemaVersion))},
+			},
+		}
+	}
+
+	writeCtx, cancel := context.WithTimeout(ctx, eventLease/2)
+	pubErr := w.WriteMessages(writeCtx, msgs...)
+	cancel()
+
+	update := map[string]interface{}{"lease_owner": "", "lease_expires_at": nil}
+	if pubErr != nil {
+		update["attempts"] = gorm.Expr("attempts + 1")
+		update["last_error"] = pubErr.Error()
+	} else {
+		update["published_at"] = time.Now()
+	}
+	if err := s.DB.Model(&CafEvent{}).Where("id IN ? AND lease_owner = ?", ids, owner).
+		Updates(update).Error; err != nil {
+		return 0, err
+	}
+	if pubErr != nil {
+		return 0, pubErr
+	}
+	return len(events), nil
+}
+
+// claimEvents leases up to limit unpublished events, oldest first, to
+// owner. A CAF with an event leased to a relay has none of its events
+// claimed by another until that lease is given up or runs out, so each
+// CAF's events are published by one relay at a time and in order. Claims
+// are serialised with an advisory lock so each sees the leases taken
+// before it; they are short, and the publishing itself runs in parallel.
+func (s *OnboardingService) claimEvents(ctx context.Context, owner string, limit int) ([]CafEvent, error) {
+	var events []CafEvent
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('caf_events'))").Error; err != nil {
+			return err
+		}
+		if err := tx.Where("published_at IS NULL").
+			Where("NOT EXISTS (SELECT 1 FROM caf_events l WHERE l.caf_ref_no = caf_events.caf_ref_no " +
+				"AND l.published_at IS NULL AND l.lease_expires_at > now())").
+			Order("id").Limit(limit).
+			Find(&events).Error; err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(events))
+		for i, e := range events {
+			ids[i] = e.ID
+		}
+		return tx.Model(&CafEvent{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"lease_owner":      owner,
+			"lease_expires_at": gorm.Expr("now() + make_interval(secs => ?)", eventLease.Seconds()),
+		}).Error
+	})
+	return events, err
+}
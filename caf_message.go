@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// CAFMessage is a CAF submission as published on the CAF Kafka topic and
+// posted to /kafka/caf.
+type CAFMessage struct {
+	MessageID string                 `json:"message_id"`
+	CafRefNo  string                 `json:"caf_ref_no"`
+	PlanCode  string                 `json:"plan_code"`
+	IMSI      string                 `json:"imsi"`
+	PosHrno   string                 `json:"pos_hrno"`
+	CSCHrno   string                 `json:"csc_hrno"`
+	ZoneCode  string                 `json:"zone_code"`
+	IsAgent   bool                   `json:"is_agent"`
+	Customer  map[string]interface{} `json:"customer"`
+}
+
+// KafkaSource identifies the Kafka record a CAF was read from.
+type KafkaSource struct {
+	Topic     string
+	Partition int
+	Offset    int64
+}
+
+// UnmarshalJSON also accepts pos_agent_hrno, the name older producers use
+// for pos_hrno.
+func (m *CAFMessage) UnmarshalJSON(data []byte) error {
+	type plain CAFMessage
+	var raw struct {
+		plain
+		PosAgentHrno string `json:"pos_agent_hrno"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = CAFMessage(raw.plain)
+	if m.PosHrno == "" {
+		m.PosHrno = raw.PosAgentHrno
+	}
+	return nil
+}
+
+// FieldError is one problem with one field of a CAFMessage.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every problem found in a CAFMessage.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		parts[i] = f.Message
+		if f.Field != "" {
+			parts[i] = f.Field + ": " + f.Message
+		}
+	}
+	return "invalid CAF message: " + strings.Join(parts, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+var imsiPattern = regexp.MustCompile(`^[0-9]{14,15}$`)
+
+// Plan codes a CAF may name, matched after trimming and upper-casing. Both
+// are comma-separated lists: CAF_PLAN_CODES the regular plans on sale, by
+// default the PLAN- family the CAF feed has always sent, CAF_USIM_PLAN_CODES
+// the USIM plans, whose permanent IMSI comes from PyIOTA.
+var (
+	planCodes     = parsePlanCodes(os.Getenv("CAF_PLAN_CODES"), "PLAN-*")
+	usimPlanCodes = parsePlanCodes(os.Getenv("CAF_USIM_PLAN_CODES"), "USIM001,USIM002,USIM003")
+)
+
+// planCodeSet is a set of plan codes. An entry ending in "*" matches every
+// code it is a prefix of.
+type planCodeSet map[string]bool
+
+func (set planCodeSet) has(code string) bool {
+	if set[code] {
+		return true
+	}
+	for entry := range set {
+		if prefix, ok := strings.CutSuffix(entry, "*"); ok && strings.HasPrefix(code, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePlanCodes parses a comma-separated list of plan codes, or def if
+// list is empty.
+func parsePlanCodes(list, def string) planCodeSet {
+	if strings.TrimSpace(list) == "" {
+		list = def
+	}
+	codes := planCodeSet{}
+	for _, code := range strings.Split(list, ",") {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			codes[code] = true
+		}
+	}
+	return codes
+}
+
+// knownZones are the zones of the onboarding.zone_config CHECK constraint.
+var knownZones = map[string]bool{"NORTH": true, "SOUTH": true, "EAST": true, "WEST": true}
+
+// hrnoZones maps POS agent HRNOs to their zone for messages without a
+// zone_code.
+var hrnoZones = map[string]string{
+	"HR001": "NORTH",
+	"HR002": "SOUTH",
+	"HR003": "EAST",
+	"HR004": "WEST",
+}
+
+// ParseCAFMessage decodes and validates a CAF message. Any problem, including
+// malformed JSON or a field of the wrong type, is returned as a
+// *ValidationError.
+func ParseCAFMessage(data []byte) (CAFMessage, error) {
+	var msg CAFMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		verr := &ValidationError{}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			verr.add(typeErr.Field, "must be a %s", typeErr.Type)
+		} else {
+			verr.add("", "malformed JSON: %v", err)
+		}
+		return msg, verr
+	}
+	return msg, msg.Validate()
+}
+
+// Validate normalises the message in place and checks it. It returns nil or
+// a *ValidationError naming every bad field.
+func (m *CAFMessage) Validate() error {
+	m.CafRefNo = strings.TrimSpace(m.CafRefNo)
+	m.MessageID = strings.TrimSpace(m.MessageID)
+	m.PlanCode = strings.ToUpper(strings.TrimSpace(m.PlanCode))
+	m.IMSI = strings.TrimSpace(m.IMSI)
+	m.ZoneCode = strings.ToUpper(strings.TrimSpace(m.ZoneCode))
+	if m.ZoneCode == "" {
+		m.ZoneCode = hrnoZones[m.PosHrno]
+	}
+
+	verr := &ValidationError{}
+	if m.CafRefNo == "" && m.MessageID == "" {
+		verr.add("caf_ref_no", "required when message_id is not set")
+	}
+
+	switch {
+	case m.PlanCode == "":
+		verr.add("plan_code", "required")
+	case !planCodes.has(m.PlanCode) && !usimPlanCodes.has(m.PlanCode):
+		verr.add("plan_code", "unknown plan %q", m.PlanCode)
+	}
+
+	switch {
+	case m.IMSI == "" && !m.IsUSIM():
+		verr.add("imsi", "required for non-USIM plans")
+	case m.IMSI != "" && !imsiPattern.MatchString(m.IMSI):
+		verr.add("imsi", "must be 14 or 15 digits")
+	}
+
+	switch {
+	case m.ZoneCode == "":
+		verr.add("zone_code", "required when pos_hrno has no known zone")
+	case !knownZones[m.ZoneCode]:
+		verr.add("zone_code", "unknown zone %q", m.ZoneCode)
+	}
+
+	if m.IsAgent && m.PosHrno == "" {
+		verr.add("pos_hrno", "required for agent CAFs")
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// RefNo is the CAF reference number, falling back to the message id.
+func (m CAFMessage) RefNo() string {
+	if m.CafRefNo != "" {
+		return m.CafRefNo
+	}
+	return m.MessageID
+}
+
+// IsUSIM reports whether the plan is a USIM plan, whose permanent IMSI comes
+// from PyIOTA.
+func (m CAFMessage) IsUSIM() bool {
+	return usimPlanCodes.has(m.PlanCode)
+}
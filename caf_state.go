@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// CAF workflow statuses. The comment on each entry of cafTransitions gives
+// the matching value in the onboarding.caf status CHECK list.
+const (
+	StatusPendingApproval   = "PENDING_APPROVAL"
+	StatusApproved          = "APPROVED"
+	StatusRejected          = "REJECTED"
+	StatusPreactSent        = "PREACT_SENT"
+	StatusPreactDone        = "PREACT_DONE"
+	StatusPreactFailed      = "PREACT_FAILED"
+	StatusPreactTimeout     = "PREACT_TIMEOUT"
+	StatusTvSent            = "TV_SENT"
+	StatusTvDone            = "TV_DONE"
+	StatusTvFailed          = "TV_FAILED"
+	StatusTvTimeout         = "TV_TIMEOUT"
+	StatusFinalactSent      = "FINALACT_SENT"
+	StatusFinalactDone      = "FINALACT_DONE"
+	StatusFinalactFailed    = "FINALACT_FAILED"
+	StatusFinalactTimeout   = "FINALACT_TIMEOUT"
+	StatusCommissionSent    = "COMMISSION_SENT"
+	StatusCommissionFailed  = "COMMISSION_FAILED"
+	StatusCommissionTimeout = "COMMISSION_TIMEOUT"
+	StatusCompleted         = "COMPLETED"
+	StatusFailed            = "FAILED"
+	StatusCancelled         = "CANCELLED"
+	StatusRollbackPending   = "ROLLBACK_PENDING"
+	StatusRollbackFailed    = "ROLLBACK_FAILED"
+	StatusRolledBack        = "ROLLED_BACK"
+)
+
+// cafTransitions is the CAF state machine: every status mapped to the
+// statuses it may move to. A status with no entries is terminal.
+var cafTransitions = map[string][]string{
+	// PENDING_KAFKA_VALIDATION, VALIDATED_IMSI, PENDING_CSC_APPROVAL
+	StatusPendingApproval: {StatusApproved, StatusRejected, StatusCancelled},
+	// CSC_APPROVED
+	StatusApproved: {StatusPreactSent, StatusCancelled},
+	// CSC_REJECTED
+	StatusRejected: {},
+	// PRE_ACTIVATION_PENDING
+	StatusPreactSent: {StatusPreactDone, StatusPreactFailed, StatusPreactTimeout, StatusCancelled},
+	// PRE_ACTIVATION_SUCCESS
+	StatusPreactDone: {StatusTvSent, StatusRollbackPending},
+	// PRE_ACTIVATION_FAILED
+	StatusPreactFailed: {StatusPreactSent, StatusFailed, StatusCancelled},
+	// PRE_ACTIVATION_FAILED (pre_activation_status TIMEOUT)
+	StatusPreactTimeout: {StatusPreactSent, StatusFailed, StatusCancelled},
+	// TELE_VERIFICATION_PENDING
+	StatusTvSent: {StatusTvDone, StatusTvFailed, StatusTvTimeout, StatusRollbackPending},
+	// TELE_VERIFICATION_SUCCESS
+	StatusTvDone: {StatusFinalactSent, StatusRollbackPending},
+	// TELE_VERIFICATION_FAILED
+	StatusTvFailed: {StatusTvSent, StatusRollbackPending, StatusFailed},
+	// TELE_VERIFICATION_FAILED (televerification_status TIMEOUT)
+	StatusTvTimeout: {StatusTvSent, StatusRollbackPending, StatusFailed},
+	// FINAL_ACTIVATION_PENDING
+	StatusFinalactSent: {StatusFinalactDone, StatusFinalactFailed, StatusFinalactTimeout, StatusRollbackPending},
+	// FINAL_ACTIVATION_SUCCESS
+	StatusFinalactDone: {StatusCommissionSent, StatusCompleted, StatusRollbackPending},
+	// FINAL_ACTIVATION_FAILED
+	StatusFinalactFailed: {StatusFinalactSent, StatusRollbackPending, StatusFailed},
+	// FINAL_ACTIVATION_FAILED (final_activation_status TIMEOUT)
+	StatusFinalactTimeout: {StatusFinalactSent, StatusRollbackPending, StatusFailed},
+	// COMMISSION_PENDING
+	StatusCommissionSent: {StatusCompleted, StatusCommissionFailed, StatusCommissionTimeout},
+	// COMMISSION_FAILED
+	StatusCommissionFailed: {StatusCommissionSent, StatusFailed},
+	// COMMISSION_FAILED
+	StatusCommissionTimeout: {StatusCommissionSent, StatusFailed},
+	// COMMISSION_SUCCESS, COMPLETED
+	StatusCompleted: {},
+	// FAILED
+	StatusFailed: {},
+	// FAILED (withdrawn before any partner acknowledged a step; reversed if
+	// a partner acknowledges a cancelled request late)
+	StatusCancelled: {StatusRollbackPending},
+	// FAILED (compensation in progress)
+	StatusRollbackPending: {StatusRolledBack, StatusRollbackFailed},
+	// FAILED (a partner refused a reversal)
+	StatusRollbackFailed: {StatusRollbackPending},
+	// FAILED (every acknowledged step reversed, unless a late ACK reopens it)
+	StatusRolledBack: {StatusRollbackPending},
+}
+
+// cafStatusStep is the CurrentStep recorded alongside each status. Failed
+// statuses keep the step that failed so it can be retried.
+var cafStatusStep = map[string]int{
+	StatusPendingApproval:   1,
+	StatusApproved:          2,
+	StatusRejected:          0,
+	StatusPreactSent:        3,
+	StatusPreactDone:        4,
+	StatusPreactFailed:      3,
+	StatusPreactTimeout:     3,
+	StatusTvSent:            5,
+	StatusTvDone:            6,
+	StatusTvFailed:          5,
+	StatusTvTimeout:         5,
+	StatusFinalactSent:      7,
+	StatusFinalactDone:      8,
+	StatusFinalactFailed:    7,
+	StatusFinalactTimeout:   7,
+	StatusCommissionSent:    9,
+	StatusCommissionFailed:  9,
+	StatusCommissionTimeout: 9,
+	StatusCompleted:         9,
+	StatusFailed:            0,
+	StatusCancelled:         0,
+	StatusRollbackPending:   0,
+	StatusRollbackFailed:    0,
+	StatusRolledBack:        0,
+}
+
+// ErrIllegalTransition is wrapped by every TransitionError.
+var ErrIllegalTransition = errors.New("illegal CAF status transition")
+
+// TransitionError reports a status change the state machine does not allow,
+// either because the edge is not in cafTransitions or because the CAF was
+// moved by someone else between load and save.
+type TransitionError struct {
+	CafRefNo string
+	From     string
+	To       string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("CAF %s: cannot move from %q to %q", e.CafRefNo, e.From, e.To)
+}
+
+func (e *TransitionError) Unwrap() error { return ErrIllegalTransition }
+
+// CanTransition reports whether the state machine allows from -> to.
+func CanTransition(from, to string) bool {
+	for _, next := range cafTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves caf to status `to` inside tx and records the change in
+// the event outbox in the same transaction. The update is guarded on the
+// status the CAF was loaded with, so a concurrent ACK cannot overwrite a
+// newer state.
+func (s *OnboardingService) transition(tx *gorm.DB, caf *Caf, to string) error {
+	from := caf.Status
+	if !CanTransition(from, to) {
+		return &TransitionError{CafRefNo: caf.CafRefNo, From: from, To: to}
+	}
+
+	moved := *caf
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&Caf{}).
+			Where("id = ? AND status = ?", caf.ID, from).
+			Updates(map[string]interface{}{"status": to, "current_step": cafStatusStep[to]})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return &TransitionError{CafRefNo: caf.CafRefNo, From: from, To: to}
+		}
+
+		moved.Status = to
+		moved.CurrentStep = cafStatusStep[to]
+		return recordTransition(tx, &moved, from)
+	})
+	if err != nil {
+		return err
+	}
+
+	*caf = moved
+	return nil
+}
+
+// ErrNoNextStep is returned by NextStep when the CAF is not waiting on an
+// operator to start its next integration step.
+var ErrNoNextStep = errors.New("no next step available")
+
+// NextStep resumes the CAF's process on the service task it is parked on,
+// which the process definition decides from the CAF's progress.
+func (s *OnboardingService) NextStep(cafRefNo string) error {
+	if _, err := s.findCaf(cafRefNo); err != nil {
+		return err
+	}
+
+	err := s.Engine.Resume(cafRefNo)
+	if errors.Is(err, ErrNotParked) {
+		return ErrNoNextStep
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrUnknownCorrelation is returned for an ACK whose correlation ID has
+	// no outbox row. The ACK is kept as an OrphanCallback.
+	ErrUnknownCorrelation = errors.New("unknown correlation ID")
+	// ErrTargetMismatch is returned for an ACK whose correlation ID belongs
+	// to another target's outbox row than the one the ACK came in for.
+	ErrTargetMismatch = errors.New("correlation ID belongs to another target")
+	// ErrCafMismatch is returned for an ACK naming another CAF than the one
+	// its correlation ID belongs to.
+	ErrCafMismatch = errors.New("correlation ID belongs to another CAF")
+	// ErrStaleCorrelation is returned for an ACK whose outbox row is no
+	// longer awaiting one: it was already answered, timed out or failed, or
+	// has been superseded by a newer request to the same target. The ACK is
+	// kept as an OrphanCallback.
+	ErrStaleCorrelation = errors.New("correlation ID is not the current request")
+)
+
+// Reasons an ACK is kept as an OrphanCallback.
+const (
+	OrphanUnknown = "UNKNOWN" // no outbox row has the correlation ID
+	OrphanStale   = "STALE"   // see ErrStaleCorrelation
+)
+
+// OrphanCallback is an ACK received for a correlation ID with no outbox
+// row, or for one that is stale, kept for investigation.
+type OrphanCallback struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	CorrelationID string    `gorm:"index" json:"correlation_id"`
+	Reason        string    `json:"reason"`
+	Source        string    `json:"source"` // callback route or DB link response table
+	AckStatus     string    `json:"ack_status,omitempty"`
+	Payload       string    `json:"payload,omitempty"`
+	RemoteAddr    string    `json:"remote_addr,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// resolveAck finds the outbox row and CAF an ACK for corrID applies to. The
+// row must be for one of targets, and cafRefNo, if the partner sent one,
+// must be its CAF's. The row must also be PENDING or SENT and the latest
+// for its target on the CAF, except that CANCELLED rows are returned for
+// ackCancelled.
+func (s *OnboardingService) resolveAck(corrID, cafRefNo string, targets ...string) (IntegrationOutbox, Caf, error) {
+	var outbox IntegrationOutbox
+	var caf Caf
+	if err := s.DB.Where("correlation_id = ?", corrID).First(&outbox).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return outbox, caf, fmt.Errorf("%w: %s", ErrUnknownCorrelation, corrID)
+		}
+		return outbox, caf, err
+	}
+
+	matched := false
+	for _, target := range targets {
+		if outbox.Target == target {
+			matched = true
+		}
+	}
+	if !matched {
+		return outbox, caf, fmt.Errorf("%w: %s is a %s request", ErrTargetMismatch, corrID, outbox.Target)
+	}
+
+	if err := s.DB.First(&caf, outbox.CafID).Error; err != nil {
+		return outbox, caf, err
+	}
+	if cafRefNo != "" && cafRefNo != caf.CafRefNo {
+		return outbox, caf, fmt.Errorf("%w: %s is for CAF %s", ErrCafMismatch, corrID, caf.CafRefNo)
+	}
+
+	switch outbox.Status {
+	case "CANCELLED":
+		return outbox, caf, nil
+	case "PENDING", "SENT":
+	default:
+		return outbox, caf, fmt.Errorf("%w: %s is %s", ErrStaleCorrelation, corrID, outbox.Status)
+	}
+	var newer int64
+	if err := s.DB.Model(&IntegrationOutbox{}).Where("caf_id = ? AND target = ? AND id > ?", outbox.CafID, outbox.Target, outbox.ID).
+		Count(&newer).Error; err != nil {
+		return outbox, caf, err
+	}
+	if newer > 0 {
+		return outbox, caf, fmt.Errorf("%w: %s has been superseded", ErrStaleCorrelation, corrID)
+	}
+	return outbox, caf, nil
+}
+
+// orphanReason returns the reason an ACK refused with err is kept as an
+// OrphanCallback, or "" if it is not kept.
+func orphanReason(err error) string {
+	switch {
+	case errors.Is(err, ErrUnknownCorrelation):
+		return OrphanUnknown
+	case errors.Is(err, ErrStaleCorrelation):
+		return OrphanStale
+	}
+	return ""
+}
+
+// recordOrphan keeps an ACK for an unknown or stale correlation ID. Failing
+// to is only logged: the ACK is rejected either way.
+func (s *OnboardingService) recordOrphan(orphan OrphanCallback) {
+	log.Printf("Orphan callback %s (%s) from %s", orphan.CorrelationID, orphan.Reason, orphan.Source)
+	if err := s.DB.Create(&orphan).Error; err != nil {
+		log.Printf("Recording orphan callback %s failed: %v", orphan.CorrelationID, err)
+	}
+}
+
+// ListOrphanCallbacks returns orphan callbacks, newest first, optionally only
+// those for corrID.
+func (s *OnboardingService) ListOrphanCallbacks(corrID string, limit int) ([]OrphanCallback, error) {
+	q := s.DB.Order("id DESC").Limit(limit)
+	if corrID != "" {
+		q = q.Where("correlation_id = ?", corrID)
+	}
+	var rows []OrphanCallback
+	return rows, q.Find(&rows).Error
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolveAck(t *testing.T) {
+	db := openTestDB(t)
+	s := &OnboardingService{DB: db}
+
+	caf := Caf{CafRefNo: "CAF-ACK-1", ZoneCode: "NORTH", Status: StatusPreactSent}
+	other := Caf{CafRefNo: "CAF-ACK-2", ZoneCode: "NORTH", Status: StatusPreactSent}
+	if err := db.Create(&[]*Caf{&caf, &other}).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Rows are created in order, so each retry of a target supersedes the
+	// one before it
+	rows := []IntegrationOutbox{
+		{CafID: caf.ID, Target: "PREACT", CorrelationID: "preact-1", Status: "FAILED"},
+		{CafID: caf.ID, Target: "PREACT", CorrelationID: "preact-2", Status: "SENT"},
+		{CafID: caf.ID, Target: "PREACT", CorrelationID: "preact-3", Status: "SENT"},
+		{CafID: caf.ID, Target: "TV", CorrelationID: "tv-acked", Status: "ACKED"},
+		{CafID: caf.ID, Target: "FINALACT", CorrelationID: "finalact-timeout", Status: "TIMEOUT"},
+		{CafID: caf.ID, Target: "COMMISSION", CorrelationID: "commission-pending", Status: "PENDING"},
+		{CafID: other.ID, Target: "TV", CorrelationID: "tv-cancelled", Status: "CANCELLED"},
+		{CafID: other.ID, Target: "TV", CorrelationID: "tv-retry", Status: "SENT"},
+	}
+	for i := range rows {
+		if err := db.Create(&rows[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		corrID   string
+		cafRefNo string
+		target   string
+		wantCaf  string
+		wantErr  error
+	}{
+		{"latest SENT row", "preact-3", "CAF-ACK-1", "PREACT", "CAF-ACK-1", nil},
+		{"without a CAF ref", "preact-3", "", "PREACT", "CAF-ACK-1", nil},
+		{"PENDING row", "commission-pending", "CAF-ACK-1", "COMMISSION", "CAF-ACK-1", nil},
+		{"CANCELLED row, even superseded", "tv-cancelled", "CAF-ACK-2", "TV", "CAF-ACK-2", nil},
+		{"superseded SENT row", "preact-2", "CAF-ACK-1", "PREACT", "", ErrStaleCorrelation},
+		{"FAILED row", "preact-1", "CAF-ACK-1", "PREACT", "", ErrStaleCorrelation},
+		{"already ACKED", "tv-acked", "CAF-ACK-1", "TV", "", ErrStaleCorrelation},
+		{"timed out", "finalact-timeout", "CAF-ACK-1", "FINALACT", "", ErrStaleCorrelation},
+		{"another target's row", "preact-3", "CAF-ACK-1", "TV", "", ErrTargetMismatch},
+		{"another CAF's row", "preact-3", "CAF-ACK-2", "PREACT", "", ErrCafMismatch},
+		{"unknown correlation ID", "preact-9", "CAF-ACK-1", "PREACT", "", ErrUnknownCorrelation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outbox, gotCaf, err := s.resolveAck(tt.corrID, tt.cafRefNo, tt.target)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if outbox.CorrelationID != tt.corrID || gotCaf.CafRefNo != tt.wantCaf {
+				t.Errorf("resolved %s on %s, want %s on %s", outbox.CorrelationID, gotCaf.CafRefNo, tt.corrID, tt.wantCaf)
+			}
+		})
+	}
+}
+
+func TestOrphanReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{ErrUnknownCorrelation, OrphanUnknown},
+		{ErrStaleCorrelation, OrphanStale},
+		{ErrTargetMismatch, ""},
+		{ErrCafMismatch, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := orphanReason(tt.err); got != tt.want {
+			t.Errorf("orphanReason(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
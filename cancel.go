@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// ErrNotCancellable is returned by CancelCAF for a CAF that has already
+// reached a terminal status, is being rolled back, or is at the commission
+// step with its SIM already active.
+var ErrNotCancellable = errors.New("CAF cannot be cancelled in its current status")
+
+// CancelCAF withdraws a CAF. Outbox rows still waiting on a partner are
+// marked CANCELLED so their late ACKs are ignored, or reversed if they
+// report a step the partner has carried out. A CAF with steps already
+// acknowledged by partners is compensated and ends ROLLED_BACK; any other
+// CAF ends CANCELLED. A CAF with a row a dispatcher is sending right now is
+// not cancelled, with ErrOutboxLeased, since that request may still reach
+// its partner.
+func (s *OnboardingService) CancelCAF(cafRefNo, reason, operator string) error {
+	caf, err := s.findCaf(cafRefNo)
+	if err != nil {
+		return err
+	}
+
+	compensate := len(cafCompensations[caf.Status]) > 0
+	switch {
+	case compensate && CanTransition(caf.Status, StatusRollbackPending):
+	case !compensate && CanTransition(caf.Status, StatusCancelled):
+	default:
+		return ErrNotCancellable
+	}
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Caf{}).Where("id = ?", caf.ID).Update("cancel_reason", reason).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&IntegrationOutbox{}).
+			Where("caf_id = ? AND status IN ?", caf.ID, outboxOpenStatuses).
+			Where("lease_expires_at IS NULL OR lease_expires_at < now()").
+			Update("status", "CANCELLED").Error; err != nil {
+			return err
+		}
+		var leased int64
+		if err := tx.Model(&IntegrationOutbox{}).
+			Where("caf_id = ? AND status IN ?", caf.ID, outboxOpenStatuses).
+			Count(&leased).Error; err != nil {
+			return err
+		}
+		if leased > 0 {
+			return ErrOutboxLeased
+		}
+		if err := s.audit(tx, caf, "CANCEL", operator, map[string]interface{}{"reason": reason}); err != nil {
+			return err
+		}
+
+		if compensate {
+			return s.compensate(tx, &caf, "cancelled: "+reason, operator)
+		}
+		return s.transition(tx, &caf, StatusCancelled)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.Engine.Terminate(cafRefNo, "cancelled: "+reason)
+	if errors.Is(err, ErrNoProcessInstance) {
+		return nil
+	}
+	return err
+}
+
+// ackCancelled reports whether outbox was cancelled with its CAF, in which
+// case the ACK is recorded and dropped. A SUCCESS for a step that can be
+// reversed means the partner carried it out anyway, so it is compensated.
+func (s *OnboardingService) ackCancelled(outbox IntegrationOutbox, caf Caf, ackStatus string) (bool, error) {
+	if outbox.Status != "CANCELLED" {
+		return false, nil
+	}
+	if ackStatus == "SUCCESS" && rollbackTargets[outbox.Target] != "" {
+		log.Printf("Reversing %s ACK %s for cancelled CAF", outbox.Target, outbox.CorrelationID)
+		return true, s.compensateLateAck(outbox, caf)
+	}
+
+	log.Printf("Ignoring %s ACK %s for cancelled CAF", outbox.Target, outbox.CorrelationID)
+	return true, s.audit(s.DB, caf, "ACK_IGNORED", "", map[string]interface{}{
+		"target":         outbox.Target,
+		"correlation_id": outbox.CorrelationID,
+		"ack_status":     ackStatus,
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	CircuitClosed   = "CLOSED"
+	CircuitOpen     = "OPEN"
+	CircuitHalfOpen = "HALF_OPEN"
+)
+
+// Circuit breaker defaults for zones with no ZoneTargetConfig row for a
+// target.
+const (
+	defaultBreakerWindow     = 20
+	defaultBreakerFailurePct = 50
+	defaultBreakerOpen       = time.Minute
+	defaultBreakerProbes     = 1
+)
+
+// breakerProbeWait is how long rows wait while a half-open circuit's probes
+// are still running.
+const breakerProbeWait = 5 * time.Second
+
+// CircuitKey identifies one partner integration: a target, in a zone, over
+// one mode.
+type CircuitKey struct {
+	Target   string
+	ZoneCode string
+	Mode     string
+}
+
+// CircuitState is a circuit breaker as reported by /health.
+type CircuitState struct {
+	Target      string     `json:"target"`
+	ZoneCode    string     `json:"zone_code"`
+	Mode        string     `json:"mode"`
+	State       string     `json:"state"`
+	Calls       int        `json:"calls"` // in the current window
+	Failures    int        `json:"failures"`
+	OpenUntil   *time.Time `json:"open_until,omitempty"`
+	LastFailure string     `json:"last_failure,omitempty"`
+}
+
+type circuitBreaker struct {
+	state       string
+	results     []bool // last calls while closed, oldest first; true is a failure
+	openUntil   time.Time
+	probes      int // probes running while half-open
+	passed      int // probes that succeeded while half-open
+	lastFailure string
+}
+
+// CircuitBreakers tracks the health of every partner integration the
+// dispatcher calls, so one that is down stops being called for a while.
+//
+// A circuit opens once BreakerFailurePct percent of its last BreakerWindow
+// calls failed. After BreakerOpenSec it goes half-open and lets up to
+// BreakerProbes calls through: any failing opens it again, and once that many
+// succeed it closes. State is kept per instance.
+type CircuitBreakers struct {
+	mu       sync.Mutex
+	breakers map[CircuitKey]*circuitBreaker
+}
+
+func NewCircuitBreakers() *CircuitBreakers {
+	return &CircuitBreakers{breakers: map[CircuitKey]*circuitBreaker{}}
+}
+
+// Allow reports whether a call for key may be made now. If not, retryAt is
+// when the circuit will next let a call through. A call that is allowed must
+// be followed by Record.
+func (b *CircuitBreakers) Allow(key CircuitKey, config ZoneTargetConfig) (ok bool, retryAt time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cb := b.breaker(key)
+	now := time.Now()
+	switch cb.state {
+	case CircuitOpen:
+		if now.Before(cb.openUntil) {
+			return false, cb.openUntil
+		}
+		cb.state = CircuitHalfOpen
+		cb.probes = 0
+		cb.passed = 0
+		fallthrough
+	case CircuitHalfOpen:
+		if cb.probes+cb.passed >= breakerProbes(config) {
+			return false, now.Add(breakerProbeWait)
+		}
+		cb.probes++
+	}
+	return true, time.Time{}
+}
+
+// Release hands back a call Allow let through that was not made.
+func (b *CircuitBreakers) Release(key CircuitKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if cb := b.breaker(key); cb.state == CircuitHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+// Record reports the outcome of a call Allow let through. failure is the
+// reason a failed call failed, or "" if it succeeded.
+func (b *CircuitBreakers) Record(key CircuitKey, config ZoneTargetConfig, failure string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cb := b.breaker(key)
+	if failure != "" {
+		cb.lastFailure = failure
+	}
+	switch cb.state {
+	case CircuitHalfOpen:
+		cb.probes--
+		if failure != "" {
+			b.open(cb, config)
+			return
+		}
+		cb.passed++
+		if cb.passed >= breakerProbes(config) {
+			cb.state = CircuitClosed
+			cb.results = nil
+		}
+	case CircuitClosed:
+		window := config.BreakerWindow
+		if window <= 0 {
+			window = defaultBreakerWindow
+		}
+		cb.results = append(cb.results, failure != "")
+		if len(cb.results) > window {
+			cb.results = cb.results[len(cb.results)-window:]
+		}
+		if len(cb.results) == window && countFailures(cb.results)*100 >= breakerFailurePct(config)*window {
+			b.open(cb, config)
+		}
+	}
+	// A call that finished after its circuit opened does not count
+}
+
+func (b *CircuitBreakers) open(cb *circuitBreaker, config ZoneTargetConfig) {
+	openFor := time.Duration(config.BreakerOpenSec) * time.Second
+	if openFor <= 0 {
+		openFor = defaultBreakerOpen
+	}
+	cb.state = CircuitOpen
+	cb.openUntil = time.Now().Add(openFor)
+	cb.results = nil
+}
+
+// States returns every circuit that has been called, ordered by target, zone
+// and mode.
+func (b *CircuitBreakers) States() []CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	states := make([]CircuitState, 0, len(b.breakers))
+	for key, cb := range b.breakers {
+		state := CircuitState{
+			Target:      key.Target,
+			ZoneCode:    key.ZoneCode,
+			Mode:        key.Mode,
+			State:       cb.state,
+			Calls:       len(cb.results),
+			Failures:    countFailures(cb.results),
+			LastFailure: cb.lastFailure,
+		}
+		if cb.state == CircuitOpen {
+			openUntil := cb.openUntil
+			state.OpenUntil = &openUntil
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Target != states[j].Target {
+			return states[i].Target < states[j].Target
+		}
+		if states[i].ZoneCode != states[j].ZoneCode {
+			return states[i].ZoneCode < states[j].ZoneCode
+		}
+		return states[i].Mode < states[j].Mode
+	})
+	return states
+}
+
+func (b *CircuitBreakers) breaker(key CircuitKey) *circuitBreaker {
+	cb := b.breakers[key]
+	if cb == nil {
+		cb = &circuitBreaker{state: CircuitClosed}
+		b.breakers[key] = cb
+	}
+	return cb
+}
+
+// partnerFailure is the reason a send counts against its circuit, or "" if
+// it does not. A partner that answered and refused the request, with a 4xx
+// other than 408 or 429, is up.
+func partnerFailure(result OutboxResult, err error) string {
+	if err == nil {
+		return ""
+	}
+	if result.Code >= 400 && result.Code < 500 && result.Code != 408 && result.Code != 429 {
+		return ""
+	}
+	return err.Error()
+}
+
+func breakerProbes(config ZoneTargetConfig) int {
+	if config.BreakerProbes <= 0 {
+		return defaultBreakerProbes
+	}
+	return config.BreakerProbes
+}
+
+func breakerFailurePct(config ZoneTargetConfig) int {
+	if config.BreakerFailurePct <= 0 {
+		return defaultBreakerFailurePct
+	}
+	return config.BreakerFailurePct
+}
+
+func countFailures(results []bool) int {
+	n := 0
+	for _, failed := range results {
+		if failed {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	config := ZoneTargetConfig{BreakerWindow: 4, BreakerFailurePct: 50, BreakerOpenSec: 60, BreakerProbes: 2}
+
+	// Each step is one call, with the state the circuit must be in after it:
+	//	S, F  Allow lets the call through, and it succeeds or fails
+	//	A     Allow lets a call through that has not finished yet
+	//	R     the last call let through is released unsent
+	//	X     Allow refuses the call
+	//	E     the open period passes
+	type step struct {
+		op    byte
+		state string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"stays closed below the failure rate", []step{
+			{'S', CircuitClosed}, {'F', CircuitClosed}, {'S', CircuitClosed}, {'S', CircuitClosed}, {'S', CircuitClosed},
+		}},
+		{"waits for a full window", []step{
+			{'F', CircuitClosed}, {'F', CircuitClosed}, {'F', CircuitClosed}, {'F', CircuitOpen},
+		}},
+		{"opens at the failure rate", []step{
+			{'S', CircuitClosed}, {'F', CircuitClosed}, {'S', CircuitClosed}, {'F', CircuitOpen},
+		}},
+		{"only counts the last window", []step{
+			{'F', CircuitClosed}, {'S', CircuitClosed}, {'S', CircuitClosed}, {'S', CircuitClosed},
+			{'S', CircuitClosed}, {'F', CircuitClosed}, {'S', CircuitClosed}, {'F', CircuitOpen},
+		}},
+		{"refuses calls while open", []step{
+			{'F', CircuitClosed}, {'F', CircuitClosed}, {'F', CircuitClosed}, {'F', CircuitOpen},
+			{'X', CircuitOpen}, {'X', CircuitOpen},
+		}},
+		{"closes once every probe passes", []step{
+			{'F', CircuitClosed}, {'F', CircuitClosed}, {'F', CircuitClosed}, {'F', CircuitOpen},
+			{'E', CircuitOpen}, {'S', CircuitHalfOpen}, {'S', CircuitClosed}, {'S', CircuitClosed},
+		}},
+		{"reopens when a probe fails", []step{
+			{'F', CircuitClosed}, {'F', CircuitClosed}, {'F', CircuitClosed}, {'F', CircuitOpen},
+			{'E', CircuitOpen}, {'S', CircuitHalfOpen}, {'F', CircuitOpen}, {'X', CircuitOpen},
+		}},
+		{"caps the probes in flight", []step{
+			{'F', CircuitClosed}, {'F', CircuitClosed}, {'F', CircuitClosed}, {'F', CircuitOpen},
+			{'E', CircuitOpen}, {'A', CircuitHalfOpen}, {'A', CircuitHalfOpen}, {'X', CircuitHalfOpen},
+		}},
+		{"frees the slot of a released probe", []step{
+			{'F', CircuitClosed}, {'F', CircuitClosed}, {'F', CircuitClosed}, {'F', CircuitOpen},
+			{'E', CircuitOpen}, {'A', CircuitHalfOpen}, {'A', CircuitHalfOpen}, {'R', CircuitHalfOpen},
+			{'S', CircuitHalfOpen},
+		}},
+	}
+
+	key := CircuitKey{Target: "PREACT", ZoneCode: "NORTH", Mode: "API"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewCircuitBreakers()
+			for i, s := range tt.steps {
+				switch s.op {
+				case 'S', 'F', 'A':
+					if ok, _ := b.Allow(key, config); !ok {
+						t.Fatalf("step %d (%c): call refused", i, s.op)
+					}
+					if s.op == 'S' {
+						b.Record(key, config, "")
+					} else if s.op == 'F' {
+						b.Record(key, config, "partner down")
+					}
+				case 'R':
+					b.Release(key)
+				case 'X':
+					ok, retryAt := b.Allow(key, config)
+					if ok {
+						t.Fatalf("step %d (X): call let through", i)
+					}
+					if !retryAt.After(time.Now()) {
+						t.Errorf("step %d (X): retryAt %v is not in the future", i, retryAt)
+					}
+				case 'E':
+					b.breakers[key].openUntil = time.Now().Add(-time.Second)
+				}
+
+				if got := b.States()[0].State; got != s.state {
+					t.Fatalf("step %d (%c): state = %s, want %s", i, s.op, got, s.state)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerReportsOpenUntil(t *testing.T) {
+	config := ZoneTargetConfig{BreakerWindow: 1, BreakerFailurePct: 100, BreakerOpenSec: 60, BreakerProbes: 1}
+	key := CircuitKey{Target: "TV", ZoneCode: "SOUTH", Mode: "API"}
+	b := NewCircuitBreakers()
+
+	b.Allow(key, config)
+	b.Record(key, config, "timeout")
+
+	states := b.States()
+	if len(states) != 1 {
+		t.Fatalf("states = %v, want one circuit", states)
+	}
+	state := states[0]
+	if state.State != CircuitOpen || state.OpenUntil == nil || state.LastFailure != "timeout" {
+		t.Fatalf("state = %+v, want OPEN with open_until and last_failure", state)
+	}
+	if wait := time.Until(*state.OpenUntil); wait < 59*time.Second || wait > 60*time.Second {
+		t.Errorf("open for %s, want 60s", wait)
+	}
+}
+
+func TestPartnerFailure(t *testing.T) {
+	down := errors.New("partner down")
+	tests := []struct {
+		name   string
+		code   int
+		err    error
+		counts bool
+	}{
+		{"success", 200, nil, false},
+		{"refused with 400", 400, down, false},
+		{"refused with 409", 409, down, false},
+		{"request timeout", 408, down, true},
+		{"too many requests", 429, down, true},
+		{"server error", 503, down, true},
+		{"no response", 0, down, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := partnerFailure(OutboxResult{Code: tt.code}, tt.err)
+			if (got != "") != tt.counts {
+				t.Errorf("partnerFailure(%d, %v) = %q, want counted %v", tt.code, tt.err, got, tt.counts)
+			}
+		})
+	}
+}
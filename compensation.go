@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrNothingToCompensate is returned by compensate for a CAF whose partners
+// have not acknowledged any step that needs reversing.
+var ErrNothingToCompensate = errors.New("CAF has no acknowledged steps to reverse")
+
+// rollbackTargets maps each reversible outbox target to the target that
+// undoes it.
+var rollbackTargets = map[string]string{
+	"PREACT":   "PREACT_ROLLBACK",
+	"FINALACT": "FINALACT_ROLLBACK",
+}
+
+// cafCompensations lists, for each status, the targets partners have already
+// acknowledged and that must be reversed if the CAF is abandoned there, in
+// the order the reversals should be applied. Once the commission step has
+// started the SIM is live, and a commission failure is escalated rather than
+// reversing the activation.
+var cafCompensations = map[string][]string{
+	StatusPreactDone:      {"PREACT"},
+	StatusTvSent:          {"PREACT"},
+	StatusTvDone:          {"PREACT"},
+	StatusTvFailed:        {"PREACT"},
+	StatusTvTimeout:       {"PREACT"},
+	StatusFinalactSent:    {"PREACT"},
+	StatusFinalactFailed:  {"PREACT"},
+	StatusFinalactTimeout: {"PREACT"},
+	StatusFinalactDone:    {"FINALACT", "PREACT"},
+}
+
+// compensate enqueues a reversal outbox row for every step of the CAF that a
+// partner has acknowledged and moves it to ROLLBACK_PENDING. RollbackAck
+// then tracks the reversals until the CAF is ROLLED_BACK.
+func (s *OnboardingService) compensate(tx *gorm.DB, caf *Caf, reason, operator string) error {
+	targets := cafCompensations[caf.Status]
+	if len(targets) == 0 {
+		return ErrNothingToCompensate
+	}
+
+	var config ZoneConfig
+	tx.Where("zone_code = ?", caf.ZoneCode).First(&config)
+
+	rows := make([]IntegrationOutbox, 0, len(targets))
+	for _, target := range targets {
+		var original IntegrationOutbox
+		tx.Where("caf_id = ? AND target = ?", caf.ID, target).Order("created_at DESC").First(&original)
+		rows = append(rows, s.reversalRow(*caf, config, target, original.CorrelationID, reason))
+	}
+
+	if err := s.transition(tx, caf, StatusRollbackPending); err != nil {
+		return err
+	}
+	if err := tx.Create(&rows).Error; err != nil {
+		return err
+	}
+	return s.audit(tx, *caf, "COMPENSATION", operator, map[string]interface{}{
+		"reason":  reason,
+		"reverse": targets,
+	})
+}
+
+// reversalRow builds the outbox row asking target's partner to undo the
+// request reverses.
+func (s *OnboardingService) reversalRow(caf Caf, config ZoneConfig, target, reverses, reason string) IntegrationOutbox {
+	corrID := fmt.Sprintf("RB-%s-%s-%d", target, caf.CafRefNo, time.Now().UnixNano())
+	payload := map[string]interface{}{
+		"caf_ref_no":   caf.CafRefNo,
+		"imsi":         s.getIMSI(caf),
+		"zone_code":    caf.ZoneCode,
+		"reverses":     reverses,
+		"reason":       reason,
+		"callback_url": fmt.Sprintf("http://localhost:3000/callback/rollback/%s", corrID),
+	}
+	payloadJSON, _ := json.Marshal(payload)
+
+	return IntegrationOutbox{
+		CafID:         caf.ID,
+		Target:        rollbackTargets[target],
+		Mode:          config.Mode(target),
+		CorrelationID: corrID,
+		Payload:       string(payloadJSON),
+		Status:        "PENDING",
+	}
+}
+
+// compensateLateAck reverses a step a partner acknowledged after its
+// request was cancelled with the CAF. The row is marked ACKED so a repeat of
+// the ACK is not reversed twice, and the CAF goes to ROLLBACK_PENDING until
+// the reversal is acknowledged.
+func (s *OnboardingService) compensateLateAck(outbox IntegrationOutbox, caf Caf) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&IntegrationOutbox{}).Where("id = ? AND status = ?", outbox.ID, "CANCELLED").
+			Update("status", "ACKED")
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+
+		var config ZoneConfig
+		tx.Where("zone_code = ?", caf.ZoneCode).First(&config)
+		reason := outbox.Target + " acknowledged after cancel"
+		reversal := s.reversalRow(caf, config, outbox.Target, outbox.CorrelationID, reason)
+		if err := tx.Create(&reversal).Error; err != nil {
+			return err
+		}
+		if caf.Status != StatusRollbackPending {
+			if err := s.transition(tx, &caf, StatusRollbackPending); err != nil {
+				return err
+			}
+		}
+		return s.audit(tx, caf, "COMPENSATION", "", map[string]interface{}{
+			"reason":         reason,
+			"reverse":        []string{outbox.Target},
+			"correlation_id": outbox.CorrelationID,
+		})
+	})
+}
+
+// compensateIfFinal starts compensation for a CAF that just failed target
+// and has no retries of it left. While retries remain the CAF stays in its
+// failed status so an operator can retry or cancel it. Callers run it in
+// inTx, so the compensation commits with the failure that caused it.
+func (s *OnboardingService) compensateIfFinal(caf Caf, target string) error {
+	left, err := s.retriesLeft(caf, target)
+	if err != nil || left > 0 {
+		return err
+	}
+	if err := s.compensate(s.DB, &caf, target+" failed after retries", ""); err != nil {
+		return err
+	}
+	return s.failAck(caf.CafRefNo, target)
+}
+
+// RollbackAck records a partner's answer to a reversal request. The CAF
+// becomes ROLLED_BACK once every reversal is acknowledged, or
+// ROLLBACK_FAILED as soon as one is refused.
+func (s *OnboardingService) RollbackAck(corrID, ackStatus string) error {
+	outbox, caf, err := s.resolveAck(corrID, "", rollbackTargetList()...)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if ackStatus != "SUCCESS" {
+			if err := tx.Model(&outbox).Update("status", "FAILED").Error; err != nil {
+				return err
+			}
+			if caf.Status == StatusRollbackFailed {
+				return nil
+			}
+			return s.transition(tx, &caf, StatusRollbackFailed)
+		}
+
+		if err := tx.Model(&outbox).Update("status", "ACKED").Error; err != nil {
+			return err
+		}
+		var pending int64
+		if err := tx.Model(&IntegrationOutbox{}).
+			Where("caf_id = ? AND target IN ? AND status IN ?", caf.ID, rollbackTargetList(), outboxOpenStatuses).
+			Count(&pending).Error; err != nil {
+			return err
+		}
+		if pending > 0 || caf.Status != StatusRollbackPending {
+			return nil
+		}
+		return s.transition(tx, &caf, StatusRolledBack)
+	})
+}
+
+// retryCompensation re-sends every reversal a partner refused or that could
+// not be delivered.
+func (s *OnboardingService) retryCompensation(caf Caf, operator string) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		var failed []IntegrationOutbox
+		if err := tx.Where("caf_id = ? AND target IN ? AND status IN ?", caf.ID, rollbackTargetList(), []string{"FAILED", "DEAD"}).
+			Find(&failed).Error; err != nil {
+			return err
+		}
+
+		for _, row := range failed {
+			corrID := fmt.Sprintf("RB-%s-%s-%d", row.Target, caf.CafRefNo, time.Now().UnixNano())
+			var payload map[string]interface{}
+			json.Unmarshal([]byte(row.Payload), &payload)
+			payload["callback_url"] = fmt.Sprintf("http://localhost:3000/callback/rollback/%s", corrID)
+			payloadJSON, _ := json.Marshal(payload)
+
+			retry := IntegrationOutbox{
+				CafID:         row.CafID,
+				Target:        row.Target,
+				Mode:          row.Mode,
+				CorrelationID: corrID,
+				Payload:       string(payloadJSON),
+				Status:        "PENDING",
+			}
+			if err := tx.Create(&retry).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&row).Update("status", "SUPERSEDED").Error; err != nil {
+				return err
+			}
+		}
+
+		if err := s.transition(tx, &caf, StatusRollbackPending); err != nil {
+			return err
+		}
+		return s.audit(tx, caf, "RETRY", operator, map[string]interface{}{
+			"target":        "ROLLBACK",
+			"failed_status": StatusRollbackFailed,
+			"reversals":     len(failed),
+		})
+	})
+}
+
+func isRollbackTarget(target string) bool {
+	for _, rollback := range rollbackTargets {
+		if rollback == target {
+			return true
+		}
+	}
+	return false
+}
+
+func rollbackTargetList() []string {
+	list := make([]string, 0, len(rollbackTargets))
+	for _, rollback := range rollbackTargets {
+		list = append(list, rollback)
+	}
+	return list
+}
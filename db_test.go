@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestDB opens the Postgres database ONBOARDING_TEST_DSN names, such as
+// the one docker compose starts, and returns a transaction on it with the
+// service's tables migrated. The transaction is rolled back when the test
+// ends. Tests using it are skipped if ONBOARDING_TEST_DSN is not set.
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("ONBOARDING_TEST_DSN")
+	if dsn == "" {
+		t.Skip("ONBOARDING_TEST_DSN is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+
+	tx := db.Begin()
+	t.Cleanup(func() {
+		tx.Rollback()
+		sqlDB.Close()
+	})
+	if err := tx.AutoMigrate(&Caf{}, &ZoneConfig{}, &ZoneTargetConfig{}, &IntegrationOutbox{}, &WorkflowAudit{},
+		&OutboxRateBucket{}, &PartnerKey{}, &OrphanCallback{}); err != nil {
+		t.Fatalf("migrating test database: %v", err)
+	}
+	return tx
+}
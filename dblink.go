@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// dblinkNotifyChannel is the channel the partner database's response tables
+// NOTIFY on insert (see partner_dblink.sql).
+const dblinkNotifyChannel = "dblink_response"
+
+// dblinkTables names, per outbox target, the partner table requests are
+// written to and the one the partner writes its responses to.
+var dblinkTables = map[string]struct{ request, response string }{
+	"PREACT":            {"dblink.preact_request", "dblink.preact_response"},
+	"TV":                {"dblink.tv_request", "dblink.tv_response"},
+	"FINALACT":          {"dblink.finalact_request", "dblink.finalact_response"},
+	"COMMISSION":        {"dblink.commission_request", "dblink.commission_response"},
+	"PREACT_ROLLBACK":   {"dblink.preact_rollback_request", "dblink.preact_rollback_response"},
+	"FINALACT_ROLLBACK": {"dblink.finalact_rollback_request", "dblink.finalact_rollback_response"},
+}
+
+// ackSteps maps each outbox target to the step that handles its ACK.
+// Reversal ACKs go to RollbackAck instead.
+var ackSteps = map[string]func(*OnboardingService, string, string, string) error{
+	"PREACT":     (*OnboardingService).Step4PreActivationAck,
+	"TV":         (*OnboardingService).Step6TeleVerificationAck,
+	"FINALACT":   (*OnboardingService).Step8FinalActivationAck,
+	"COMMISSION": (*OnboardingService).Step10CommissionAck,
+}
+
+// DBLinkSender writes outbox rows into the partner database's request table
+// for their target. The partner answers later through its response table.
+type DBLinkSender struct {
+	DB *gorm.DB
+}
+
+func (d DBLinkSender) Send(ctx context.Context, row IntegrationOutbox, config ZoneTargetConfig) (OutboxResult, error) {
+	tables, ok := dblinkTables[row.Target]
+	if !ok {
+		return OutboxResult{}, fmt.Errorf("no DB link request table for %s", row.Target)
+	}
+	err := d.DB.WithContext(ctx).Exec(
+		"INSERT INTO "+tables.request+" (correlation_id, zone_code, payload) VALUES (?, ?, CAST(? AS jsonb)) "+
+			"ON CONFLICT (correlation_id) DO NOTHING",
+		row.CorrelationID, config.ZoneCode, row.Payload).Error
+	return OutboxResult{}, err
+}
+
+// dblinkResponse is an unprocessed row of a partner response table.
+type dblinkResponse struct {
+	ID            int64
+	CorrelationID string
+	AckStatus     string
+}
+
+// DBLinkResponses turns the rows partners write to their response tables
+// into ACKs, handled exactly like the HTTP callbacks.
+type DBLinkResponses struct {
+	Service *OnboardingService
+	DB      *gorm.DB // partner database
+	DSN     string   // partner database, for LISTEN; empty only polls
+}
+
+// Run calls Poll every interval, and as soon as the partner database
+// notifies a new response, until ctx is done.
+func (r *DBLinkResponses) Run(ctx context.Context, interval time.Duration) {
+	var notify <-chan *pq.Notification
+	if r.DSN != "" {
+		listener := pq.NewListener(r.DSN, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("DB link listener: %v", err)
+			}
+		})
+		defer listener.Close()
+		if err := listener.Listen(dblinkNotifyChannel); err != nil {
+			log.Printf("DB link LISTEN failed, polling only: %v", err)
+		} else {
+			notify = listener.Notify
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-notify:
+		}
+		if _, err := r.Poll(ctx); err != nil {
+			log.Printf("DB link response poll failed: %v", err)
+		}
+	}
+}
+
+// Poll handles every unprocessed response row. A row is marked processed
+// once its ACK is applied or refused for good; one that failed for any
+// other reason is left to be tried again.
+func (r *DBLinkResponses) Poll(ctx context.Context) (int, error) {
+	handled := 0
+	for target, tables := range dblinkTables {
+		err := r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			var rows []dblinkResponse
+			if err := tx.Raw("SELECT id, correlation_id, ack_status FROM " + tables.response +
+				" WHERE processed_at IS NULL ORDER BY id LIMIT 100 FOR UPDATE SKIP LOCKED").
+				Scan(&rows).Error; err != nil {
+				return err
+			}
+
+			for _, row := range rows {
+				ackErr := r.Service.handleAck(target, row.CorrelationID, row.AckStatus)
+				if ackErr != nil && !finalAckError(ackErr) {
+					log.Printf("DB link %s ACK %s failed, will retry: %v", target, row.CorrelationID, ackErr)
+					continue
+				}
+				errText := ""
+				if ackErr != nil {
+					errText = ackErr.Error()
+					log.Printf("DB link %s ACK %s refused: %v", target, row.CorrelationID, ackErr)
+				}
+				if reason := orphanReason(ackErr); reason != "" {
+					r.Service.recordOrphan(OrphanCallback{
+						CorrelationID: row.CorrelationID,
+						Reason:        reason,
+						Source:        tables.response,
+						AckStatus:     row.AckStatus,
+					})
+				}
+				if err := tx.Exec("UPDATE "+tables.response+" SET processed_at = now(), error = ? WHERE id = ?",
+					errText, row.ID).Error; err != nil {
+					return err
+				}
+				handled++
+			}
+			return nil
+		})
+		if err != nil {
+			return handled, fmt.Errorf("%s: %w", tables.response, err)
+		}
+	}
+	return handled, nil
+}
+
+// handleAck applies a partner ACK for the outbox row corrID of target.
+func (s *OnboardingService) handleAck(target, corrID, ackStatus string) error {
+	if isRollbackTarget(target) {
+		return s.RollbackAck(corrID, ackStatus)
+	}
+
+	step := ackSteps[target]
+	if step == nil {
+		return fmt.Errorf("no ACK handler for %s", target)
+	}
+	return step(s, corrID, ackStatus, "")
+}
+
+// finalAckError reports whether an ACK failed in a way retrying will not
+// fix, such as a correlation ID with no outbox row or a CAF that has
+// already moved on.
+func finalAckError(err error) bool {
+	return errors.Is(err, gorm.ErrRecordNotFound) ||
+		errors.Is(err, ErrUnknownCorrelation) ||
+		errors.Is(err, ErrTargetMismatch) ||
+		errors.Is(err, ErrCafMismatch) ||
+		errors.Is(err, ErrStaleCorrelation) ||
+		errors.Is(err, ErrIllegalTransition) ||
+		errors.Is(err, ErrNoProcessInstance) ||
+		errors.Is(err, ErrNotWaiting)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// FlowableClient talks to the Flowable REST API: the runtime service under
+// /service and the external worker job API under /external-job-api.
+// BaseURL and HTTP can point at a local stub of the API.
+type FlowableClient struct {
+	BaseURL  string // e.g. http://localhost:8081/flowable-rest
+	HTTP     *http.Client
+	Username string
+	Password string
+	WorkerID string
+}
+
+// FlowableError is returned for a non-2xx response.
+type FlowableError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *FlowableError) Error() string {
+	return fmt.Sprintf("flowable %s %s: HTTP %d: %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+// FlowableVariable is a process variable as the REST API encodes it.
+type FlowableVariable struct {
+	Name  string      `json:"name"`
+	Type  string      `json:"type,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+// ExternalJob is a job acquired from the external worker job API.
+type ExternalJob struct {
+	ID                string             `json:"id"`
+	ElementID         string             `json:"elementId"`
+	ProcessInstanceID string             `json:"processInstanceId"`
+	Retries           int                `json:"retries"`
+	Variables         []FlowableVariable `json:"variables"`
+}
+
+// FlowableProcessInstance is a runtime process instance.
+type FlowableProcessInstance struct {
+	ID          string `json:"id"`
+	BusinessKey string `json:"businessKey"`
+	Ended       bool   `json:"ended"`
+}
+
+// FlowableTask is a runtime user task.
+type FlowableTask struct {
+	ID                string `json:"id"`
+	TaskDefinitionKey string `json:"taskDefinitionKey"`
+}
+
+// NewFlowableClient returns a client for the REST API at baseURL, with no
+// credentials until Username and Password are set. A nil httpClient uses one
+// with a 30s timeout.
+func NewFlowableClient(baseURL string, httpClient *http.Client) *FlowableClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	host, _ := os.Hostname()
+	return &FlowableClient{
+		BaseURL:  baseURL,
+		HTTP:     httpClient,
+		WorkerID: fmt.Sprintf("onboarding-%s-%d", host, os.Getpid()),
+	}
+}
+
+// AcquireJobs locks up to n jobs of topic for this worker.
+func (c *FlowableClient) AcquireJobs(ctx context.Context, topic string, lock time.Duration, n int) ([]ExternalJob, error) {
+	var jobs []ExternalJob
+	err := c.do(ctx, "POST", "/external-job-api/acquire/jobs", map[string]interface{}{
+		"topic":         topic,
+		"lockDuration":  isoDuration(lock),
+		"numberOfTasks": n,
+		"workerId":      c.WorkerID,
+	}, &jobs)
+	return jobs, err
+}
+
+// CompleteJob completes an acquired job, setting vars on its process.
+func (c *FlowableClient) CompleteJob(ctx context.Context, jobID string, vars []FlowableVariable) error {
+	return c.do(ctx, "POST", "/external-job-api/acquire/jobs/"+url.PathEscape(jobID)+"/complete", map[string]interface{}{
+		"workerId":  c.WorkerID,
+		"variables": vars,
+	}, nil)
+}
+
+// FailJob reports an acquired job as failed. Flowable offers it again after
+// retryTimeout while retries is above zero.
+func (c *FlowableClient) FailJob(ctx context.Context, jobID, message string, retries int, retryTimeout time.Duration) error {
+	return c.do(ctx, "POST", "/external-job-api/acquire/jobs/"+url.PathEscape(jobID)+"/fail", map[string]interface{}{
+		"workerId":     c.WorkerID,
+		"errorMessage": message,
+		"retries":      retries,
+		"retryTimeout": isoDuration(retryTimeout),
+	}, nil)
+}
+
+// ListJobs returns the external worker jobs of a process instance.
+func (c *FlowableClient) ListJobs(ctx context.Context, processInstanceID string) ([]ExternalJob, error) {
+	var page struct {
+		Data []ExternalJob `json:"data"`
+	}
+	err := c.do(ctx, "GET", "/external-job-api/jobs?processInstanceId="+url.QueryEscape(processInstanceID), nil, &page)
+	return page.Data, err
+}
+
+// StartProcess starts processKey with businessKey and vars.
+func (c *FlowableClient) StartProcess(ctx context.Context, processKey, businessKey string, vars []FlowableVariable) (FlowableProcessInstance, error) {
+	var inst FlowableProcessInstance
+	err := c.do(ctx, "POST", "/service/runtime/process-instances", map[string]interface{}{
+		"processDefinitionKey": processKey,
+		"businessKey":          businessKey,
+		"variables":            vars,
+	}, &inst)
+	return inst, err
+}
+
+// FindProcessInstances returns the running instances of processKey with
+// businessKey.
+func (c *FlowableClient) FindProcessInstances(ctx context.Context, processKey, businessKey string) ([]FlowableProcessInstance, error) {
+	var page struct {
+		Data []FlowableProcessInstance `json:"data"`
+	}
+	q := url.Values{"processDefinitionKey": {processKey}, "businessKey": {businessKey}}
+	err := c.do(ctx, "GET", "/service/runtime/process-instances?"+q.Encode(), nil, &page)
+	return page.Data, err
+}
+
+// DeleteProcessInstance deletes a running instance.
+func (c *FlowableClient) DeleteProcessInstance(ctx context.Context, id, reason string) error {
+	return c.do(ctx, "DELETE", "/service/runtime/process-instances/"+url.PathEscape(id)+"?deleteReason="+url.QueryEscape(reason), nil, nil)
+}
+
+// FindTasks returns the open user tasks of an instance with taskKey.
+func (c *FlowableClient) FindTasks(ctx context.Context, processInstanceID, taskKey string) ([]FlowableTask, error) {
+	var page struct {
+		Data []FlowableTask `json:"data"`
+	}
+	q := url.Values{"processInstanceId": {processInstanceID}, "taskDefinitionKey": {taskKey}}
+	err := c.do(ctx, "GET", "/service/runtime/tasks?"+q.Encode(), nil, &page)
+	return page.Data, err
+}
+
+// CompleteTask completes a user task, setting vars on its process.
+func (c *FlowableClient) CompleteTask(ctx context.Context, taskID string, vars []FlowableVariable) error {
+	return c.do(ctx, "POST", "/service/runtime/tasks/"+url.PathEscape(taskID), map[string]interface{}{
+		"action":    "complete",
+		"variables": vars,
+	}, nil)
+}
+
+// Deploy deploys a BPMN document as resource name.
+func (c *FlowableClient) Deploy(ctx context.Context, name string, data []byte) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(data); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	path := "/service/repository/deployments"
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return c.send(req, path, nil)
+}
+
+func (c *FlowableClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, path, out)
+}
+
+func (c *FlowableClient) send(req *http.Request, path string, out interface{}) error {
+	method := req.Method
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &FlowableError{Method: method, Path: path, StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// flowableVariables encodes vars for the REST API. Maps and slices are sent
+// as json variables.
+func flowableVariables(vars map[string]interface{}) []FlowableVariable {
+	list := make([]FlowableVariable, 0, len(vars))
+	for name, value := range vars {
+		v := FlowableVariable{Name: name, Value: value}
+		switch value.(type) {
+		case string:
+			v.Type = "string"
+		case bool:
+			v.Type = "boolean"
+		case int, int32, int64:
+			v.Type = "long"
+		case float32, float64:
+			v.Type = "double"
+		case map[string]interface{}, []interface{}, []string:
+			v.Type = "json"
+		}
+		list = append(list, v)
+	}
+	return list
+}
+
+// variableMap decodes a job's variables by name.
+func (j ExternalJob) variableMap() map[string]interface{} {
+	vars := make(map[string]interface{}, len(j.Variables))
+	for _, v := range j.Variables {
+		vars[v.Name] = v.Value
+	}
+	return vars
+}
+
+// isoDuration formats d as the ISO-8601 duration Flowable expects.
+func isoDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%dS", int(d.Round(time.Second)/time.Second))
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+)
+
+// Defaults for ExternalWorker.
+const (
+	defaultJobLock      = 30 * time.Second
+	defaultJobPoll      = 5 * time.Second
+	defaultJobBatch     = 10
+	defaultRetryTimeout = time.Minute
+)
+
+// ExternalWorker executes the external worker jobs of one topic with its
+// Delegate. A job whose delegate waits (ErrWaitForSignal or
+// ErrWaitForResume) is left locked and is acquired again once LockDuration
+// runs out.
+type ExternalWorker struct {
+	Client       *FlowableClient
+	Def          *ProcessDefinition
+	Topic        string
+	Delegate     Delegate
+	LockDuration time.Duration
+	PollInterval time.Duration
+	BatchSize    int
+}
+
+// Run polls for jobs until ctx is done.
+func (w *ExternalWorker) Run(ctx context.Context) {
+	interval := w.PollInterval
+	if interval == 0 {
+		interval = defaultJobPoll
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.Poll(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Flowable worker %s: %v", w.Topic, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll acquires one batch of jobs and handles each. It returns how many
+// jobs were completed.
+func (w *ExternalWorker) Poll(ctx context.Context) (int, error) {
+	lock, batch := w.LockDuration, w.BatchSize
+	if lock == 0 {
+		lock = defaultJobLock
+	}
+	if batch == 0 {
+		batch = defaultJobBatch
+	}
+
+	jobs, err := w.Client.AcquireJobs(ctx, w.Topic, lock, batch)
+	if err != nil {
+		return 0, err
+	}
+
+	completed := 0
+	for _, job := range jobs {
+		done, err := w.handle(ctx, job)
+		if err != nil {
+			log.Printf("Flowable job %s (%s): %v", job.ID, job.ElementID, err)
+		}
+		if done {
+			completed++
+		}
+	}
+	return completed, nil
+}
+
+// handle runs job's delegate and completes the job with the task's
+// resultVariableName set to the delegate's result. A delegate error fails
+// the job so Flowable retries it.
+func (w *ExternalWorker) handle(ctx context.Context, job ExternalJob) (bool, error) {
+	node := w.Def.Nodes[job.ElementID]
+	if node == nil {
+		err := fmt.Errorf("element %q is not in process %q", job.ElementID, w.Def.Key)
+		return false, w.Client.FailJob(ctx, job.ID, err.Error(), 0, 0)
+	}
+
+	vars := job.variableMap()
+	cafRefNo, _ := vars["cafRefNo"].(string)
+	result, err := w.Delegate(&TaskContext{CafRefNo: cafRefNo, Node: node, Variables: vars})
+	switch {
+	case errors.Is(err, ErrWaitForSignal), errors.Is(err, ErrWaitForResume):
+		return false, nil
+	case err != nil:
+		retries := job.Retries - 1
+		if retries < 0 {
+			retries = 0
+		}
+		if failErr := w.Client.FailJob(ctx, job.ID, err.Error(), retries, defaultRetryTimeout); failErr != nil {
+			return false, failErr
+		}
+		return false, err
+	}
+
+	out := map[string]interface{}{}
+	if name := node.Fields["resultVariableName"]; name != "" && result != nil {
+		out[name] = result
+	}
+	return true, w.Client.CompleteJob(ctx, job.ID, flowableVariables(out))
+}
+
+// FlowableWorkflow runs the CAF's process on a Flowable server, with the
+// process's service tasks executed by ExternalWorkers. Instances are found
+// by business key, which is the CAF ref no.
+type FlowableWorkflow struct {
+	Client    *FlowableClient
+	def       *ProcessDefinition
+	delegates map[string]Delegate
+}
+
+// NewFlowableWorkflow checks that every service task in def has a delegate.
+func NewFlowableWorkflow(client *FlowableClient, def *ProcessDefinition, delegates map[string]Delegate) (*FlowableWorkflow, error) {
+	for _, node := range def.Nodes {
+		if node.Kind == NodeServiceTask && delegates[node.Delegate] == nil {
+			return nil, fmt.Errorf("no worker registered for topic %q (task %q)", node.Delegate, node.ID)
+		}
+	}
+	return &FlowableWorkflow{Client: client, def: def, delegates: delegates}, nil
+}
+
+// delegateExpressionAttr matches the delegateExpression of a service task
+// in flowable-bpmn.xml.
+var delegateExpressionAttr = regexp.MustCompile(`flowable:delegateExpression="\$\{(\w+)\}"`)
+
+// externalWorkerBPMN turns the delegateExpression service tasks of a BPMN
+// document into external worker tasks on the topic named by the
+// expression, which is the delegate the task's ExternalWorker runs.
+func externalWorkerBPMN(doc string) string {
+	return delegateExpressionAttr.ReplaceAllString(doc, `flowable:type="external-worker" flowable:topic="$1"`)
+}
+
+// Deploy deploys doc, the BPMN the process definition was parsed from, with
+// its service tasks done by this workflow's ExternalWorkers.
+func (f *FlowableWorkflow) Deploy(ctx context.Context, doc string) error {
+	return f.Client.Deploy(ctx, f.def.Key+".bpmn20.xml", []byte(externalWorkerBPMN(doc)))
+}
+
+// RunWorkers runs one ExternalWorker per topic until ctx is done.
+func (f *FlowableWorkflow) RunWorkers(ctx context.Context, pollInterval time.Duration) {
+	for topic, delegate := range f.delegates {
+		w := &ExternalWorker{
+			Client:       f.Client,
+			Def:          f.def,
+			Topic:        topic,
+			Delegate:     delegate,
+			PollInterval: pollInterval,
+		}
+		go w.Run(ctx)
+	}
+	<-ctx.Done()
+}
+
+// Start starts the CAF's process instance. Starting a CAF that already has
+// a running instance does nothing.
+func (f *FlowableWorkflow) Start(cafRefNo string, vars map[string]interface{}) error {
+	ctx := context.Background()
+	existing, err := f.Client.FindProcessInstances(ctx, f.def.Key, cafRefNo)
+	if err != nil || len(existing) > 0 {
+		return err
+	}
+	_, err = f.Client.StartProcess(ctx, f.def.Key, cafRefNo, flowableVariables(vars))
+	return err
+}
+
+// Signal completes the user task key. Service tasks cannot be signalled:
+// their worker picks the outcome up from the CAF the next time it acquires
+// the job.
+func (f *FlowableWorkflow) Signal(cafRefNo, key string, result interface{}, vars map[string]interface{}) error {
+	node := f.def.activity(key)
+	if node == nil {
+		return fmt.Errorf("%w: no activity %q", ErrNotWaiting, key)
+	}
+	if node.Kind != NodeUserTask {
+		return nil
+	}
+
+	ctx := context.Background()
+	inst, err := f.instance(ctx, cafRefNo)
+	if err != nil {
+		return err
+	}
+	tasks, err := f.Client.FindTasks(ctx, inst.ID, node.ID)
+	if err != nil {
+		return err
+	}
+	if len(tasks) == 0 {
+		return fmt.Errorf("%w: %s has no open %s task", ErrNotWaiting, cafRefNo, node.ID)
+	}
+
+	out := map[string]interface{}{}
+	for k, v := range vars {
+		out[k] = v
+	}
+	if name := node.Fields["resultVariableName"]; name != "" && result != nil {
+		out[name] = result
+	}
+	return f.Client.CompleteTask(ctx, tasks[0].ID, flowableVariables(out))
+}
+
+// Fail terminates the instance unless a conditional flow out of key
+// matches result, in which case the worker completes the task and Flowable
+// follows that flow.
+func (f *FlowableWorkflow) Fail(cafRefNo, key string, result interface{}) error {
+	node := f.def.activity(key)
+	if node == nil {
+		return fmt.Errorf("%w: no activity %q", ErrNotWaiting, key)
+	}
+	vars := map[string]interface{}{node.Fields["resultVariableName"]: result}
+	if _, ok := f.def.next(node, vars, true); ok {
+		return nil
+	}
+	return f.Terminate(cafRefNo, "failed at "+node.ID)
+}
+
+// Resume runs the service task whose job is parked waiting for NextStep.
+// The worker completes the job when it next acquires it.
+func (f *FlowableWorkflow) Resume(cafRefNo string) error {
+	ctx := context.Background()
+	inst, err := f.instance(ctx, cafRefNo)
+	if err != nil {
+		return err
+	}
+	jobs, err := f.Client.ListJobs(ctx, inst.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		node := f.def.Nodes[job.ElementID]
+		if node == nil || node.Kind != NodeServiceTask {
+			continue
+		}
+		_, err := f.delegates[node.Delegate](&TaskContext{
+			CafRefNo:  cafRefNo,
+			Node:      node,
+			Variables: job.variableMap(),
+			Resumed:   true,
+		})
+		if errors.Is(err, ErrWaitForSignal) || errors.Is(err, ErrWaitForResume) {
+			return ErrNotParked
+		}
+		return err
+	}
+	return ErrNotParked
+}
+
+// Terminate deletes the CAF's running instance.
+func (f *FlowableWorkflow) Terminate(cafRefNo, reason string) error {
+	ctx := context.Background()
+	inst, err := f.instance(ctx, cafRefNo)
+	if err != nil {
+		return err
+	}
+	return f.Client.DeleteProcessInstance(ctx, inst.ID, reason)
+}
+
+func (f *FlowableWorkflow) instance(ctx context.Context, cafRefNo string) (FlowableProcessInstance, error) {
+	found, err := f.Client.FindProcessInstances(ctx, f.def.Key, cafRefNo)
+	if err != nil {
+		return FlowableProcessInstance{}, err
+	}
+	if len(found) == 0 {
+		return FlowableProcessInstance{}, ErrNoProcessInstance
+	}
+	return found[0], nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// jobAPIStub serves the external worker job API, handing out jobs once and
+// recording what the worker reports back.
+type jobAPIStub struct {
+	mu        sync.Mutex
+	jobs      []ExternalJob
+	acquired  []map[string]interface{}
+	completed map[string]map[string]interface{}
+	failed    map[string]map[string]interface{}
+}
+
+func newJobAPIStub(t *testing.T, jobs ...ExternalJob) (*jobAPIStub, *FlowableClient) {
+	stub := &jobAPIStub{
+		jobs:      jobs,
+		completed: map[string]map[string]interface{}{},
+		failed:    map[string]map[string]interface{}{},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(stub.serve))
+	t.Cleanup(srv.Close)
+	return stub, NewFlowableClient(srv.URL, srv.Client())
+}
+
+func (s *jobAPIStub) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || r.Method != "POST" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	const prefix = "/external-job-api/acquire/jobs"
+	switch path := r.URL.Path; {
+	case path == prefix:
+		s.acquired = append(s.acquired, body)
+		json.NewEncoder(w).Encode(s.jobs)
+		s.jobs = nil
+	case strings.HasSuffix(path, "/complete"):
+		s.completed[strings.TrimSuffix(strings.TrimPrefix(path, prefix+"/"), "/complete")] = body
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "/fail"):
+		s.failed[strings.TrimSuffix(strings.TrimPrefix(path, prefix+"/"), "/fail")] = body
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func testWorker(t *testing.T, client *FlowableClient, delegate Delegate) *ExternalWorker {
+	def, err := ParseProcessDefinition([]byte(bpmnXML), processKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ExternalWorker{Client: client, Def: def, Topic: "integrationService", Delegate: delegate}
+}
+
+func preActivationJob() ExternalJob {
+	return ExternalJob{
+		ID:        "job-1",
+		ElementID: "preActivation",
+		Retries:   3,
+		Variables: []FlowableVariable{{Name: "cafRefNo", Type: "string", Value: "CAF-1"}},
+	}
+}
+
+func TestExternalWorkerCompletesJobWithResultVariable(t *testing.T) {
+	stub, client := newJobAPIStub(t, preActivationJob())
+	var got *TaskContext
+	worker := testWorker(t, client, func(ctx *TaskContext) (interface{}, error) {
+		got = ctx
+		return map[string]interface{}{"status": StatusPreactSent}, nil
+	})
+
+	completed, err := worker.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completed != 1 {
+		t.Fatalf("completed = %d, want 1", completed)
+	}
+
+	if len(stub.acquired) != 1 || stub.acquired[0]["topic"] != "integrationService" {
+		t.Fatalf("acquire requests = %v", stub.acquired)
+	}
+	if got == nil || got.CafRefNo != "CAF-1" || got.Node.Fields["operation"] != "PRE_ACTIVATION" {
+		t.Fatalf("delegate called with %+v", got)
+	}
+
+	body, ok := stub.completed["job-1"]
+	if !ok {
+		t.Fatalf("job-1 not completed; failed = %v", stub.failed)
+	}
+	vars, _ := body["variables"].([]interface{})
+	if len(vars) != 1 {
+		t.Fatalf("variables = %v, want only preActivationResult", body["variables"])
+	}
+	v := vars[0].(map[string]interface{})
+	value, _ := v["value"].(map[string]interface{})
+	if v["name"] != "preActivationResult" || v["type"] != "json" || value["status"] != StatusPreactSent {
+		t.Fatalf("variable = %v", v)
+	}
+}
+
+func TestExternalWorkerFailsJobWithRetriesDecremented(t *testing.T) {
+	stub, client := newJobAPIStub(t, preActivationJob())
+	worker := testWorker(t, client, func(ctx *TaskContext) (interface{}, error) {
+		return nil, errors.New("partner down")
+	})
+
+	completed, err := worker.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completed != 0 {
+		t.Fatalf("completed = %d, want 0", completed)
+	}
+	if len(stub.completed) != 0 {
+		t.Fatalf("completed jobs = %v, want none", stub.completed)
+	}
+
+	body, ok := stub.failed["job-1"]
+	if !ok {
+		t.Fatal("job-1 not failed")
+	}
+	if body["retries"] != float64(2) {
+		t.Errorf("retries = %v, want 2", body["retries"])
+	}
+	if body["errorMessage"] != "partner down" {
+		t.Errorf("errorMessage = %v", body["errorMessage"])
+	}
+	if body["retryTimeout"] != isoDuration(defaultRetryTimeout) {
+		t.Errorf("retryTimeout = %v", body["retryTimeout"])
+	}
+}
+
+func TestExternalWorkerLeavesWaitingJobLocked(t *testing.T) {
+	for _, wait := range []error{ErrWaitForSignal, ErrWaitForResume} {
+		stub, client := newJobAPIStub(t, preActivationJob())
+		worker := testWorker(t, client, func(ctx *TaskContext) (interface{}, error) {
+			return nil, wait
+		})
+
+		completed, err := worker.Poll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if completed != 0 || len(stub.completed) != 0 || len(stub.failed) != 0 {
+			t.Errorf("%v: completed %d, complete calls %v, fail calls %v; want the job left locked",
+				wait, completed, stub.completed, stub.failed)
+		}
+	}
+}
+
+func TestExternalWorkerBPMNUsesDelegateTopics(t *testing.T) {
+	doc := externalWorkerBPMN(bpmnXML)
+	if strings.Contains(doc, "delegateExpression") {
+		t.Fatal("delegateExpression left in the deployed BPMN")
+	}
+	for _, topic := range []string{"cafValidationService", "integrationService", "callbackService"} {
+		if !strings.Contains(doc, `flowable:type="external-worker" flowable:topic="`+topic+`"`) {
+			t.Errorf("no external worker task on topic %s", topic)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IdempotencyKeyHeader is the request header clients set to make a
+// mutating request safe to retry.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// defaultIdempotencyTTL is how long a key is remembered before
+// RunIdempotencyCleanup deletes it.
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// IdempotencyRecord is the first request made with an Idempotency-Key to
+// one method and path and, once it has finished, its response. StatusCode
+// is 0 while the first request is still running.
+type IdempotencyRecord struct {
+	Key         string    `gorm:"primaryKey" json:"key"`
+	Method      string    `gorm:"primaryKey" json:"method"`
+	Path        string    `gorm:"primaryKey" json:"path"`
+	RequestHash string    `json:"request_hash"`
+	StatusCode  int       `json:"status_code"`
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+	CreatedAt   time.Time `gorm:"index" json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// TableName gives the table the name app.go's pgx store uses in the
+// onboarding schema. GORM creates it in the default schema, like the rest of
+// this service's tables.
+func (IdempotencyRecord) TableName() string {
+	return "idempotency_keys"
+}
+
+// IdempotencyStore keeps IdempotencyRecords for IdempotencyMiddleware.
+// Records are identified by their key, method and path.
+type IdempotencyStore interface {
+	// Begin claims rec's key for a new request. If the key is already taken
+	// it returns the existing record and false.
+	Begin(ctx context.Context, rec IdempotencyRecord) (IdempotencyRecord, bool, error)
+	// Complete stores the response of the request that claimed rec's key.
+	Complete(ctx context.Context, rec IdempotencyRecord, status int, contentType string, body []byte) error
+	// Release frees rec's key so the request can be retried.
+	Release(ctx context.Context, rec IdempotencyRecord) error
+	// Expire deletes the records created before cutoff.
+	Expire(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// IdempotencyMiddleware makes POST, PUT, PATCH and DELETE requests that
+// carry an Idempotency-Key header run at most once per key, method and
+// path, so keys chosen by different clients for different endpoints do not
+// collide. A repeat with the same body gets the first response back, with
+// an Idempotent-Replayed header; a repeat with another body is rejected
+// with 422, and one that arrives while the first is still running with 409.
+// Keys are forgotten after RunIdempotencyCleanup's TTL.
+//
+// Server errors are not stored, so a request that failed with a 5xx can be
+// retried with the same key. Requests without the header are not affected.
+//
+// Mount it after any authentication, so a stored response is only replayed
+// to a caller allowed to make the request.
+func IdempotencyMiddleware(store IdempotencyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" || !isMutating(c.Request.Method) {
+			c.Next()
+			return
+		}
+		if len(key) > 255 {
+			c.AbortWithStatusJSON(400, gin.H{"error": IdempotencyKeyHeader + " must be at most 255 characters"})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := requestHash(c.Request.Method, c.Request.URL.Path, body)
+		claim := IdempotencyRecord{
+			Key:         key,
+			Method:      c.Request.Method,
+			Path:        c.Request.URL.Path,
+			RequestHash: hash,
+		}
+		rec, claimed, err := store.Begin(c.Request.Context(), claim)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if !claimed {
+			replayIdempotent(c, rec, hash)
+			return
+		}
+
+		w := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		completed := false
+		defer func() {
+			// Also runs when a handler panics, so the key is not left claimed
+			if completed {
+				return
+			}
+			if err := store.Release(context.Background(), claim); err != nil {
+				log.Printf("Releasing idempotency key %q failed: %v", key, err)
+			}
+		}()
+
+		c.Next()
+
+		status := w.Status()
+		if status >= 500 {
+			return
+		}
+		if err := store.Complete(context.Background(), claim, status, w.Header().Get("Content-Type"), w.body.Bytes()); err != nil {
+			log.Printf("Storing response for idempotency key %q failed: %v", key, err)
+			return
+		}
+		completed = true
+	}
+}
+
+// RunIdempotencyCleanup deletes idempotency records older than ttl every
+// interval until ctx is done.
+func RunIdempotencyCleanup(ctx context.Context, store IdempotencyStore, ttl, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := store.Expire(ctx, time.Now().Add(-ttl))
+			if err != nil {
+				log.Printf("Idempotency key cleanup failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Deleted %d expired idempotency keys", n)
+			}
+		}
+	}
+}
+
+// replayIdempotent answers a request whose key was claimed before.
+func replayIdempotent(c *gin.Context, rec IdempotencyRecord, hash string) {
+	switch {
+	case rec.RequestHash != hash:
+		c.AbortWithStatusJSON(422, gin.H{
+			"error":  IdempotencyKeyHeader + " was already used for a different request",
+			"method": rec.Method,
+			"path":   rec.Path,
+		})
+	case rec.StatusCode == 0:
+		c.AbortWithStatusJSON(409, gin.H{"error": "a request with this " + IdempotencyKeyHeader + " is still in progress"})
+	default:
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(rec.StatusCode, rec.ContentType, rec.Body)
+		c.Abort()
+	}
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// requestHash identifies a request for comparing repeats of the same key.
+func requestHash(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordingWriter keeps a copy of the response body.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// GormIdempotencyStore is an IdempotencyStore on the service database.
+type GormIdempotencyStore struct {
+	DB *gorm.DB
+}
+
+func (s GormIdempotencyStore) Begin(ctx context.Context, rec IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	res := s.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&rec)
+	if res.Error != nil {
+		return rec, false, res.Error
+	}
+	if res.RowsAffected == 1 {
+		return rec, true, nil
+	}
+
+	var existing IdempotencyRecord
+	err := s.DB.WithContext(ctx).First(&existing, "key = ? AND method = ? AND path = ?", rec.Key, rec.Method, rec.Path).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Released between the insert and the read
+		return s.Begin(ctx, rec)
+	}
+	return existing, false, err
+}
+
+func (s GormIdempotencyStore) Complete(ctx context.Context, rec IdempotencyRecord, status int, contentType string, body []byte) error {
+	return s.DB.WithContext(ctx).Model(&IdempotencyRecord{}).
+		Where("key = ? AND method = ? AND path = ?", rec.Key, rec.Method, rec.Path).Updates(map[string]interface{}{
+		"status_code":  status,
+		"content_type": contentType,
+		"body":         body,
+	}).Error
+}
+
+func (s GormIdempotencyStore) Release(ctx context.Context, rec IdempotencyRecord) error {
+	return s.DB.WithContext(ctx).Where("key = ? AND method = ? AND path = ? AND status_code = 0", rec.Key, rec.Method, rec.Path).
+		Delete(&IdempotencyRecord{}).Error
+}
+
+func (s GormIdempotencyStore) Expire(ctx context.Context, cutoff time.Time) (int64, error) {
+	res := s.DB.WithContext(ctx).Where("created_at < ?", cutoff).Delete(&IdempotencyRecord{})
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// memIdempotencyStore is an IdempotencyStore in memory.
+type memIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[[3]string]IdempotencyRecord
+}
+
+func newMemIdempotencyStore() *memIdempotencyStore {
+	return &memIdempotencyStore{records: map[[3]string]IdempotencyRecord{}}
+}
+
+func recordKey(rec IdempotencyRecord) [3]string {
+	return [3]string{rec.Key, rec.Method, rec.Path}
+}
+
+func (s *memIdempotencyStore) Begin(ctx context.Context, rec IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.records[recordKey(rec)]; ok {
+		return existing, false, nil
+	}
+	rec.CreatedAt = time.Now()
+	s.records[recordKey(rec)] = rec
+	return rec, true, nil
+}
+
+func (s *memIdempotencyStore) Complete(ctx context.Context, rec IdempotencyRecord, status int, contentType string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec = s.records[recordKey(rec)]
+	rec.StatusCode, rec.ContentType, rec.Body = status, contentType, body
+	s.records[recordKey(rec)] = rec
+	return nil
+}
+
+func (s *memIdempotencyStore) Release(ctx context.Context, rec IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records[recordKey(rec)].StatusCode == 0 {
+		delete(s.records, recordKey(rec))
+	}
+	return nil
+}
+
+func (s *memIdempotencyStore) Expire(ctx context.Context, cutoff time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for k, rec := range s.records {
+		if rec.CreatedAt.Before(cutoff) {
+			delete(s.records, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	type request struct {
+		method, path, key, body string
+	}
+	tests := []struct {
+		name       string
+		status     int // what the handler answers with
+		first      request
+		second     request
+		wantStatus int
+		wantCalls  int
+		wantReplay bool
+	}{
+		{
+			name:       "same body is replayed",
+			status:     201,
+			first:      request{"POST", "/caf", "k1", `{"caf_id":"CAF-1"}`},
+			second:     request{"POST", "/caf", "k1", `{"caf_id":"CAF-1"}`},
+			wantStatus: 201,
+			wantCalls:  1,
+			wantReplay: true,
+		},
+		{
+			name:       "client errors are replayed",
+			status:     400,
+			first:      request{"POST", "/caf", "k1", `{}`},
+			second:     request{"POST", "/caf", "k1", `{}`},
+			wantStatus: 400,
+			wantCalls:  1,
+			wantReplay: true,
+		},
+		{
+			name:       "different body is rejected",
+			status:     201,
+			first:      request{"POST", "/caf", "k1", `{"caf_id":"CAF-1"}`},
+			second:     request{"POST", "/caf", "k1", `{"caf_id":"CAF-2"}`},
+			wantStatus: 422,
+			wantCalls:  1,
+		},
+		{
+			name:       "server errors release the key",
+			status:     503,
+			first:      request{"POST", "/caf", "k1", `{"caf_id":"CAF-1"}`},
+			second:     request{"POST", "/caf", "k1", `{"caf_id":"CAF-1"}`},
+			wantStatus: 503,
+			wantCalls:  2,
+		},
+		{
+			name:       "keys are scoped to the path",
+			status:     200,
+			first:      request{"POST", "/caf/CAF-1/cancel", "k1", `{}`},
+			second:     request{"POST", "/caf/CAF-2/cancel", "k1", `{}`},
+			wantStatus: 200,
+			wantCalls:  2,
+		},
+		{
+			name:       "requests without a key always run",
+			status:     201,
+			first:      request{"POST", "/caf", "", `{"caf_id":"CAF-1"}`},
+			second:     request{"POST", "/caf", "", `{"caf_id":"CAF-1"}`},
+			wantStatus: 201,
+			wantCalls:  2,
+		},
+		{
+			name:       "reads are not recorded",
+			status:     200,
+			first:      request{"GET", "/caf", "k1", ``},
+			second:     request{"GET", "/caf", "k1", ``},
+			wantStatus: 200,
+			wantCalls:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			r := gin.New()
+			r.Use(IdempotencyMiddleware(newMemIdempotencyStore()))
+			r.Any("/*path", func(c *gin.Context) {
+				calls++
+				c.JSON(tt.status, gin.H{"call": calls})
+			})
+
+			send := func(req request) *httptest.ResponseRecorder {
+				httpReq := httptest.NewRequest(req.method, req.path, strings.NewReader(req.body))
+				if req.key != "" {
+					httpReq.Header.Set(IdempotencyKeyHeader, req.key)
+				}
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httpReq)
+				return w
+			}
+			first := send(tt.first)
+			second := send(tt.second)
+
+			if second.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%s)", second.Code, tt.wantStatus, second.Body)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("handler ran %d times, want %d", calls, tt.wantCalls)
+			}
+			replayed := second.Header().Get("Idempotent-Replayed") == "true"
+			if replayed != tt.wantReplay {
+				t.Errorf("replayed = %v, want %v", replayed, tt.wantReplay)
+			}
+			if tt.wantReplay && second.Body.String() != first.Body.String() {
+				t.Errorf("replayed body = %s, want %s", second.Body, first.Body)
+			}
+		})
+	}
+}
+
+func TestIdempotencyMiddlewareInProgress(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store := newMemIdempotencyStore()
+	body := `{"caf_id":"CAF-1"}`
+	store.Begin(context.Background(), IdempotencyRecord{
+		Key:         "k1",
+		Method:      http.MethodPost,
+		Path:        "/caf",
+		RequestHash: requestHash(http.MethodPost, "/caf", []byte(body)),
+	})
+
+	r := gin.New()
+	r.Use(IdempotencyMiddleware(store))
+	r.POST("/caf", func(c *gin.Context) {
+		t.Error("handler ran while the first request was in progress")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/caf", strings.NewReader(body))
+	req.Header.Set(IdempotencyKeyHeader, "k1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("status = %d, want 409 (%s)", w.Code, w.Body)
+	}
+}
+
+func TestIdempotencyMiddlewareReleasesOnPanic(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store := newMemIdempotencyStore()
+	r := gin.New()
+	r.Use(gin.Recovery(), IdempotencyMiddleware(store))
+	r.POST("/caf", func(c *gin.Context) {
+		panic("handler failed")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/caf", strings.NewReader(`{}`))
+	req.Header.Set(IdempotencyKeyHeader, "k1")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(store.records) != 0 {
+		t.Errorf("records = %v, want the key released", store.records)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// consumerRetryDelay is how long a consumer worker waits before handling a
+// record again after neither Step 1 nor the quarantine could store it.
+const consumerRetryDelay = 5 * time.Second
+
+// Defaults for ConsumerConfig.
+const (
+	defaultConsumerWorkers     = 8
+	defaultConsumerMaxInFlight = 100
+	defaultConsumerMaxAttempts = 5
+)
+
+// ConsumerConfig sizes the CAF consumer's worker pool.
+type ConsumerConfig struct {
+	Workers     int // records are spread over this many workers by caf_ref_no
+	MaxInFlight int // fetched but not yet stored records, across all workers
+	MaxAttempts int // failed Step 1 runs before a record is quarantined
+}
+
+// RunCAFConsumer reads CAF records until ctx is done, then drains: records
+// already handed to a worker are finished and committed before it returns.
+//
+// Records with the same caf_ref_no always go to the same worker, so they
+// are stored in the order they were read. A partition's offset is committed
+// only up to the last record that, with every record before it, has been
+// stored by HandleCAFRecord, so a crash redelivers rather than loses.
+func (s *OnboardingService) RunCAFConsumer(ctx context.Context, r *kafka.Reader, cfg ConsumerConfig) {
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultConsumerWorkers
+	}
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = defaultConsumerMaxInFlight
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultConsumerMaxAttempts
+	}
+
+	slots := make(chan struct{}, cfg.MaxInFlight)
+	done := make(chan kafka.Message, cfg.MaxInFlight)
+	tracker := newOffsetTracker()
+
+	var workers sync.WaitGroup
+	queues := make([]chan kafka.Message, cfg.Workers)
+	for i := range queues {
+		queues[i] = make(chan kafka.Message, cfg.MaxInFlight)
+		workers.Add(1)
+		go func(queue <-chan kafka.Message) {
+			defer workers.Done()
+			for msg := range queue {
+				if s.storeCAFRecord(ctx, msg, cfg.MaxAttempts) {
+					done <- msg
+				}
+				<-slots
+			}
+		}(queues[i])
+	}
+
+	committed := make(chan struct{})
+	go func() {
+		defer close(committed)
+		for msg := range done {
+			if upTo, ok := tracker.done(msg); ok {
+				// Commits must still go through while draining
+				if err := r.CommitMessages(context.Background(), upTo); err != nil {
+					log.Printf("Kafka commit failed (partition %d, offset %d): %v", upTo.Partition, upTo.Offset, err)
+				}
+			}
+		}
+	}()
+
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		msg, err := r.FetchMessage(ctx)
+		if err != nil {
+			<-slots
+			if ctx.Err() != nil {
+				break
+			}
+			log.Println("Kafka error:", err)
+			continue
+		}
+		tracker.fetched(msg)
+		queues[shard(orderingKey(msg), cfg.Workers)] <- msg
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	workers.Wait()
+	close(done)
+	<-committed
+	log.Println("Kafka consumer drained")
+}
+
+// storeCAFRecord calls HandleCAFRecord until the record is stored, and
+// quarantines it once it has failed maxAttempts times, so a record Step 1
+// can never store does not hold up its partition's commits. It gives up,
+// leaving the record uncommitted, if ctx ends while it is retrying.
+func (s *OnboardingService) storeCAFRecord(ctx context.Context, msg kafka.Message, maxAttempts int) bool {
+	for attempt := 1; ; attempt++ {
+		// A record already being handled is finished even while draining
+		err := s.HandleCAFRecord(context.Background(), msg)
+		if err != nil && attempt >= maxAttempts {
+			log.Printf("CAF record failed %d times (partition %d, offset %d), quarantining: %v", attempt, msg.Partition, msg.Offset, err)
+			err = s.Quarantine(context.Background(), msg, err)
+		}
+		if err == nil {
+			return true
+		}
+		log.Printf("CAF record not stored (partition %d, offset %d), retrying: %v", msg.Partition, msg.Offset, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(consumerRetryDelay):
+		}
+	}
+}
+
+// HandleCAFRecord runs a record through Step 1, quarantining it if it does
+// not parse or validate. It returns nil once the record is durably stored
+// either way. Any other failure, such as the database being down, is
+// returned so the record is retried, until storeCAFRecord gives up on it.
+// Step 1 is idempotent on caf_ref_no, so a redelivered record is harmless.
+func (s *OnboardingService) HandleCAFRecord(ctx context.Context, msg kafka.Message) error {
+	cafMsg, err := ParseCAFMessage(msg.Value)
+	if err == nil {
+		err = s.Step1ProcessKafkaCAF(cafMsg, KafkaSource{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset})
+	}
+	if err == nil {
+		log.Printf("✅ Step 1 COMPLETE: CAF %s -> PENDING_APPROVAL", cafMsg.RefNo())
+		return nil
+	}
+
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		return err
+	}
+	log.Printf("CAF processing failed (partition %d, offset %d): %v", msg.Partition, msg.Offset, err)
+	return s.Quarantine(ctx, msg, err)
+}
+
+// orderingKey is the record's caf_ref_no, falling back to its Kafka key and
+// then its partition for records that do not parse.
+func orderingKey(msg kafka.Message) string {
+	var ref struct {
+		CafRefNo  string `json:"caf_ref_no"`
+		MessageID string `json:"message_id"`
+	}
+	if json.Unmarshal(msg.Value, &ref) == nil {
+		if ref.CafRefNo != "" {
+			return ref.CafRefNo
+		}
+		if ref.MessageID != "" {
+			return ref.MessageID
+		}
+	}
+	if len(msg.Key) > 0 {
+		return string(msg.Key)
+	}
+	return "partition-" + strconv.Itoa(msg.Partition)
+}
+
+func shard(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// offsetTracker finds, per partition, the highest offset below which every
+// fetched record has been stored.
+type offsetTracker struct {
+	mu      sync.Mutex
+	pending map[int][]int64        // fetched offsets not yet committed, in fetch order
+	stored  map[int]map[int64]bool // of those, the ones already stored
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		pending: map[int][]int64{},
+		stored:  map[int]map[int64]bool{},
+	}
+}
+
+func (t *offsetTracker) fetched(msg kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[msg.Partition] = append(t.pending[msg.Partition], msg.Offset)
+	if t.stored[msg.Partition] == nil {
+		t.stored[msg.Partition] = map[int64]bool{}
+	}
+}
+
+// done marks msg stored. It returns the record to commit up to, if the
+// contiguous stored prefix of msg's partition grew.
+func (t *offsetTracker) done(msg kafka.Message) (kafka.Message, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := msg.Partition
+	t.stored[p][msg.Offset] = true
+
+	advanced := false
+	var upTo int64
+	for len(t.pending[p]) > 0 && t.stored[p][t.pending[p][0]] {
+		upTo = t.pending[p][0]
+		delete(t.stored[p], upTo)
+		t.pending[p] = t.pending[p][1:]
+		advanced = true
+	}
+	if !advanced {
+		return kafka.Message{}, false
+	}
+	return kafka.Message{Topic: msg.Topic, Partition: p, Offset: upTo}, true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestOffsetTrackerCommitsInOrder(t *testing.T) {
+	// commit is the offset done must return for each completion, or -1
+	// when the committable prefix does not grow.
+	type completion struct {
+		partition int
+		offset    int64
+		commit    int64
+	}
+	tests := []struct {
+		name    string
+		fetched map[int][]int64
+		done    []completion
+	}{
+		{
+			name:    "in order",
+			fetched: map[int][]int64{0: {10, 11, 12}},
+			done:    []completion{{0, 10, 10}, {0, 11, 11}, {0, 12, 12}},
+		},
+		{
+			name:    "later record first",
+			fetched: map[int][]int64{0: {10, 11, 12}},
+			done:    []completion{{0, 12, -1}, {0, 11, -1}, {0, 10, 12}},
+		},
+		{
+			name:    "gap filled in the middle",
+			fetched: map[int][]int64{0: {10, 11, 12, 13}},
+			done:    []completion{{0, 10, 10}, {0, 12, -1}, {0, 13, -1}, {0, 11, 13}},
+		},
+		{
+			name:    "partitions are independent",
+			fetched: map[int][]int64{0: {10, 11}, 1: {5, 6}},
+			done:    []completion{{1, 6, -1}, {0, 10, 10}, {1, 5, 6}, {0, 11, 11}},
+		},
+		{
+			name:    "offsets need not be contiguous",
+			fetched: map[int][]int64{0: {10, 14, 20}},
+			done:    []completion{{0, 20, -1}, {0, 10, 10}, {0, 14, 20}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newOffsetTracker()
+			for partition, offsets := range tt.fetched {
+				for _, offset := range offsets {
+					tracker.fetched(kafka.Message{Topic: "caf", Partition: partition, Offset: offset})
+				}
+			}
+			for i, c := range tt.done {
+				msg, ok := tracker.done(kafka.Message{Topic: "caf", Partition: c.partition, Offset: c.offset})
+				switch {
+				case c.commit < 0 && ok:
+					t.Fatalf("completion %d (p%d@%d): commit %d, want none", i, c.partition, c.offset, msg.Offset)
+				case c.commit >= 0 && !ok:
+					t.Fatalf("completion %d (p%d@%d): no commit, want %d", i, c.partition, c.offset, c.commit)
+				case ok && (msg.Partition != c.partition || msg.Offset != c.commit || msg.Topic != "caf"):
+					t.Fatalf("completion %d (p%d@%d): commit %s p%d@%d, want caf p%d@%d",
+						i, c.partition, c.offset, msg.Topic, msg.Partition, msg.Offset, c.partition, c.commit)
+				}
+			}
+		})
+	}
+}
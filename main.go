@@ -6,13 +6,17 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -34,6 +38,11 @@ type Caf struct {
 	Status         string         `json:"status"`
 	IsAgent        bool           `json:"is_agent"`
 	CurrentStep    int            `json:"current_step"`
+	CancelReason   string         `json:"cancel_reason,omitempty"`
+	LastError      string         `json:"last_error,omitempty"` // why the last partner delivery gave up
+	KafkaTopic     string         `json:"kafka_topic"`
+	KafkaPartition int            `json:"kafka_partition"`
+	KafkaOffset    int64          `json:"kafka_offset"`
 	CreatedAt      time.Time      `json:"created_at"`
 	UpdatedAt      time.Time      `json:"updated_at"`
 }
@@ -44,22 +53,122 @@ type ZoneConfig struct {
 	TvMode         string `json:"tv_mode"`
 	FinalactMode   string `json:"finalact_mode"`
 	CommissionMode string `json:"commission_mode"`
+
+	// AUTO starts the step as soon as the previous step's ACK succeeds,
+	// MANUAL waits for POST /caf/:caf_ref_no/next.
+	TvAdvance         string `gorm:"default:MANUAL" json:"tv_advance"`
+	FinalactAdvance   string `gorm:"default:MANUAL" json:"finalact_advance"`
+	CommissionAdvance string `gorm:"default:AUTO" json:"commission_advance"`
+
+	// AllowUnsigned lets the zone's partners be called and call back without
+	// a signature while they are enrolled. Signed callbacks are still checked.
+	AllowUnsigned bool `json:"allow_unsigned"`
+}
+
+const (
+	AdvanceAuto   = "AUTO"
+	AdvanceManual = "MANUAL"
+)
+
+// AdvanceMode returns the zone's advance setting for the step sending to target.
+func (z ZoneConfig) AdvanceMode(target string) string {
+	switch target {
+	case "TV":
+		return z.TvAdvance
+	case "FINALACT":
+		return z.FinalactAdvance
+	case "COMMISSION":
+		return z.CommissionAdvance
+	}
+	return AdvanceManual
+}
+
+// Mode returns the zone's integration mode (API or DBLINK) for target.
+func (z ZoneConfig) Mode(target string) string {
+	switch target {
+	case "PREACT":
+		return z.PreactMode
+	case "TV":
+		return z.TvMode
+	case "FINALACT":
+		return z.FinalactMode
+	case "COMMISSION":
+		return z.CommissionMode
+	}
+	return ""
+}
+
+// ZoneTargetConfig holds settings for one integration target in one zone.
+type ZoneTargetConfig struct {
+	ZoneCode      string `gorm:"primaryKey" json:"zone_code"`
+	Target        string `gorm:"primaryKey" json:"target"`
+	AckTimeoutSec int    `gorm:"default:900" json:"ack_timeout_sec"`
+	OnTimeout     string `gorm:"default:ESCALATE" json:"on_timeout"` // RETRY or ESCALATE
+	Endpoint      string `json:"endpoint"`                           // partner URL in API mode
+
+	// Outbox delivery: failed attempts are retried after BackoffBaseSec,
+	// doubling up to BackoffMaxSec, until MaxAttempts have been made.
+	MaxAttempts    int `gorm:"default:5" json:"max_attempts"`
+	BackoffBaseSec int `gorm:"default:10" json:"backoff_base_sec"`
+	BackoffMaxSec  int `gorm:"default:600" json:"backoff_max_sec"`
+
+	// Step retries, by an operator or on timeout: a failed step may be sent
+	// again MaxRetries times after its first attempt (see RetryStep).
+	MaxRetries int `gorm:"default:3" json:"max_retries"`
+
+	// Circuit breaker (see CircuitBreakers): opens once BreakerFailurePct
+	// percent of the last BreakerWindow calls failed, and lets
+	// BreakerProbes calls through again after BreakerOpenSec.
+	BreakerWindow     int `gorm:"default:20" json:"breaker_window"`
+	BreakerFailurePct int `gorm:"default:50" json:"breaker_failure_pct"`
+	BreakerOpenSec    int `gorm:"default:60" json:"breaker_open_sec"`
+	BreakerProbes     int `gorm:"default:1" json:"breaker_probes"`
+
+	// Throttling, 0 for none: at most RateLimitTPS sends a second, in bursts
+	// of up to RateBurst, and at most MaxInFlight rows being sent or SENT
+	// awaiting an ACK.
+	RateLimitTPS float64 `json:"rate_limit_tps"`
+	RateBurst    int     `json:"rate_burst"`
+	MaxInFlight  int     `json:"max_in_flight"`
 }
 
 type IntegrationOutbox struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	CafID          uint       `json:"caf_id"`
+	Target         string     `json:"target"`
+	Mode           string     `json:"mode"`
+	CorrelationID  string     `gorm:"unique" json:"correlation_id"`
+	Payload        string     `json:"payload"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	ResponseCode   int        `json:"response_code,omitempty"`
+	Response       string     `json:"response,omitempty"` // partner's synchronous reply to the last attempt
+	LastError      string     `json:"last_error,omitempty"`
+	NextAttemptAt  *time.Time `gorm:"index" json:"next_attempt_at,omitempty"` // nil: as soon as possible
+	LeaseOwner     string     `json:"lease_owner,omitempty"`                  // dispatcher sending the row
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+	SendingSince   *time.Time `json:"sending_since,omitempty"` // admitted under MaxInFlight, while leased
+	SentAt         *time.Time `json:"sent_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// WorkflowAudit mirrors onboarding.workflow_audit: one row per notable
+// action taken on a CAF.
+type WorkflowAudit struct {
 	ID            uint      `gorm:"primaryKey" json:"id"`
-	CafID         uint      `json:"caf_id"`
-	Target        string    `json:"target"`
-	Mode          string    `json:"mode"`
-	CorrelationID string    `gorm:"unique" json:"correlation_id"`
-	Payload       string    `json:"payload"`
+	CafID         uint      `gorm:"index" json:"caf_id"`
+	StepNumber    int       `json:"step_number"`
+	StepName      string    `json:"step_name"`
 	Status        string    `json:"status"`
-	Attempts      int       `json:"attempts"`
-	CreatedAt     time.Time `json:"created_at"`
+	Details       string    `json:"details"`
+	ExecutedBy    string    `gorm:"default:SYSTEM" json:"executed_by"`
+	ExecutionTime time.Time `gorm:"autoCreateTime" json:"execution_time"`
 }
 
 type OnboardingService struct {
-	DB *gorm.DB
+	DB         *gorm.DB
+	Engine     Workflow
+	DeadLetter *kafka.Writer // CAF messages that fail Step 1; nil disables
 }
 
 func NewOnboardingService() *OnboardingService {
@@ -70,45 +179,96 @@ func NewOnboardingService() *OnboardingService {
 	}
 
 	// Auto migrate
-	db.AutoMigrate(&Caf{}, &ZoneConfig{}, &IntegrationOutbox{})
+	db.AutoMigrate(&Caf{}, &ZoneConfig{}, &ZoneTargetConfig{}, &IntegrationOutbox{}, &WorkflowAudit{}, &ProcessInstance{}, &QuarantinedMessage{}, &CafEvent{}, &IdempotencyRecord{}, &OutboxAttempt{}, &OutboxRateBucket{}, &PartnerKey{}, &OrphanCallback{})
 
 	// Seed zone config
 	var count int64
 	db.Model(&ZoneConfig{}).Count(&count)
 	if count == 0 {
-		db.Create(&ZoneConfig{ZoneCode: "NORTH", PreactMode: "API", TvMode: "DBLINK", FinalactMode: "API", CommissionMode: "DBLINK"})
-		db.Create(&ZoneConfig{ZoneCode: "SOUTH", PreactMode: "DBLINK", TvMode: "API", FinalactMode: "DBLINK", CommissionMode: "API"})
+		db.Create(&ZoneConfig{ZoneCode: "NORTH", PreactMode: "API", TvMode: "DBLINK", FinalactMode: "API", CommissionMode: "DBLINK",
+			TvAdvance: AdvanceAuto, FinalactAdvance: AdvanceAuto, CommissionAdvance: AdvanceAuto})
+		db.Create(&ZoneConfig{ZoneCode: "SOUTH", PreactMode: "DBLINK", TvMode: "API", FinalactMode: "DBLINK", CommissionMode: "API",
+			TvAdvance: AdvanceManual, FinalactAdvance: AdvanceManual, CommissionAdvance: AdvanceAuto})
+	}
+
+	db.Model(&ZoneTargetConfig{}).Count(&count)
+	if count == 0 {
+		for _, zone := range []string{"NORTH", "SOUTH"} {
+			partner := "http://localhost:8090/" + strings.ToLower(zone)
+			db.Create(&ZoneTargetConfig{ZoneCode: zone, Target: "PREACT", AckTimeoutSec: 300, OnTimeout: TimeoutRetry, Endpoint: partner + "/preact"})
+			db.Create(&ZoneTargetConfig{ZoneCode: zone, Target: "TV", AckTimeoutSec: 3600, OnTimeout: TimeoutEscalate, Endpoint: partner + "/tv"})
+			db.Create(&ZoneTargetConfig{ZoneCode: zone, Target: "FINALACT", AckTimeoutSec: 600, OnTimeout: TimeoutRetry, Endpoint: partner + "/finalact"})
+			db.Create(&ZoneTargetConfig{ZoneCode: zone, Target: "COMMISSION", AckTimeoutSec: 86400, OnTimeout: TimeoutEscalate, Endpoint: partner + "/commission"})
+			db.Create(&ZoneTargetConfig{ZoneCode: zone, Target: "PREACT_ROLLBACK", Endpoint: partner + "/preact/rollback"})
+			db.Create(&ZoneTargetConfig{ZoneCode: zone, Target: "FINALACT_ROLLBACK", Endpoint: partner + "/finalact/rollback"})
+		}
 	}
 
-	return &OnboardingService{DB: db}
+	service := &OnboardingService{DB: db}
+
+	// Step ordering comes from flowable-bpmn.xml
+	def, err := ParseProcessDefinition([]byte(bpmnXML), processKey)
+	if err != nil {
+		panic("Failed to load BPMN process: " + err.Error())
+	}
+	if url := os.Getenv("FLOWABLE_REST_URL"); url != "" {
+		// Run on a Flowable server, with service tasks done by external workers
+		client := NewFlowableClient(url, nil)
+		client.Username = os.Getenv("FLOWABLE_REST_USER")
+		client.Password = os.Getenv("FLOWABLE_REST_PASSWORD")
+		var flowable *FlowableWorkflow
+		flowable, err = NewFlowableWorkflow(client, def, service.flowableDelegates())
+		if err == nil {
+			if deployErr := flowable.Deploy(context.Background(), bpmnXML); deployErr != nil {
+				log.Printf("Warning: Failed to deploy BPMN to Flowable: %v", deployErr)
+			}
+		}
+		service.Engine = flowable
+	} else {
+		service.Engine, err = NewProcessEngine(db, def, service.processDelegates())
+	}
+	if err != nil {
+		panic("Failed to start process engine: " + err.Error())
+	}
+
+	return service
 }
 
 // ===== STEP 1: Kafka CAF Processing =====
-func (s *OnboardingService) Step1ProcessKafkaCAF(cafData map[string]interface{}) error {
-	planCode := cafData["plan_code"].(string)
-	isUsim := strings.Contains(strings.ToUpper(planCode), "USIM")
+func (s *OnboardingService) Step1ProcessKafkaCAF(msg CAFMessage, source KafkaSource) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
 
 	caf := Caf{
-		CafRefNo:    cafData["caf_ref_no"].(string),
-		PlanCode:    planCode,
-		IsUsim:      isUsim,
-		PosHrno:     cafData["pos_hrno"].(string),
-		ZoneCode:    cafData["zone_code"].(string),
-		IsAgent:     cafData["is_agent"].(bool),
-		Status:      "PENDING_APPROVAL",
-		CurrentStep: 1,
+		CafRefNo:       msg.RefNo(),
+		PlanCode:       msg.PlanCode,
+		IsUsim:         msg.IsUSIM(),
+		PosHrno:        msg.PosHrno,
+		ZoneCode:       msg.ZoneCode,
+		IsAgent:        msg.IsAgent,
+		Status:         StatusPendingApproval,
+		CurrentStep:    cafStatusStep[StatusPendingApproval],
+		KafkaTopic:     source.Topic,
+		KafkaPartition: source.Partition,
+		KafkaOffset:    source.Offset,
 	}
 
 	// USIM: PyIOTA API
-	if isUsim {
-		permanentIMSI := s.mockPyIOTA(planCode)
+	if caf.IsUsim {
+		permanentIMSI := s.mockPyIOTA(msg.PlanCode)
 		caf.PermanentImsi = sql.NullString{String: permanentIMSI, Valid: true}
 	} else {
-		caf.Imsi = sql.NullString{String: cafData["imsi"].(string), Valid: true}
+		caf.Imsi = sql.NullString{String: msg.IMSI, Valid: true}
 	}
 
 	// Idempotent insert
-	return s.DB.Where("caf_ref_no = ?", caf.CafRefNo).FirstOrCreate(&caf).Error
+	return s.inTx(func(s *OnboardingService) error {
+		if err := s.DB.Where("caf_ref_no = ?", caf.CafRefNo).FirstOrCreate(&caf).Error; err != nil {
+			return err
+		}
+		return s.startProcess(caf)
+	})
 }
 
 func (s *OnboardingService) mockPyIOTA(planCode string) string {
@@ -117,31 +277,91 @@ func (s *OnboardingService) mockPyIOTA(planCode string) string {
 	return fmt.Sprintf("IMSI-%s-%d", strings.ReplaceAll(planCode, "PLAN-", ""), time.Now().UnixNano())
 }
 
+func (s *OnboardingService) findCaf(cafRefNo string) (Caf, error) {
+	var caf Caf
+	err := s.DB.Where("caf_ref_no = ?", cafRefNo).First(&caf).Error
+	return caf, err
+}
+
+// audit records an action on caf in the workflow audit trail.
+func (s *OnboardingService) audit(tx *gorm.DB, caf Caf, stepName, executedBy string, details map[string]interface{}) error {
+	if executedBy == "" {
+		executedBy = "SYSTEM"
+	}
+	detailsJSON, _ := json.Marshal(details)
+	return tx.Create(&WorkflowAudit{
+		CafID:      caf.ID,
+		StepNumber: caf.CurrentStep,
+		StepName:   stepName,
+		Status:     caf.Status,
+		Details:    string(detailsJSON),
+		ExecutedBy: executedBy,
+	}).Error
+}
+
+// autoAdvance reports whether the CAF's zone starts the step sending to
+// target right after the previous ACK, instead of waiting for NextStep.
+func (s *OnboardingService) autoAdvance(caf Caf, target string) bool {
+	var config ZoneConfig
+	if err := s.DB.Where("zone_code = ?", caf.ZoneCode).First(&config).Error; err != nil {
+		return false
+	}
+	return config.AdvanceMode(target) == AdvanceAuto
+}
+
 // ===== STEP 2: CSC Approval =====
 func (s *OnboardingService) Step2CSCApproval(cafRefNo string, approved bool, cscUser string) error {
-	var caf Caf
-	if err := s.DB.Where("caf_ref_no = ?", cafRefNo).First(&caf).Error; err != nil {
+	caf, err := s.findCaf(cafRefNo)
+	if err != nil {
 		return err
 	}
 
+	status := StatusApproved
 	if !approved {
-		caf.Status = "REJECTED"
-		caf.CurrentStep = 0
-	} else {
-		caf.Status = "APPROVED"
-		caf.CurrentStep = 2
+		status = StatusRejected
 	}
+	return s.inTx(func(s *OnboardingService) error {
+		if err := s.transition(s.DB, &caf, status); err != nil {
+			return err
+		}
+		return s.Engine.Signal(cafRefNo, "cscApproval", nil, map[string]interface{}{
+			"cscApprovalOutcome": status,
+			"cscApprover":        cscUser,
+		})
+	})
+}
+
+// ErrNoZoneConfig is returned by a send step for a CAF whose zone has no
+// ZoneConfig, or no mode for the step's target.
+var ErrNoZoneConfig = errors.New("zone has no integration config")
 
-	return s.DB.Save(&caf).Error
+// stepMode returns the mode the CAF's zone sends target's requests over.
+func (s *OnboardingService) stepMode(caf Caf, target string) (string, error) {
+	var config ZoneConfig
+	err := s.DB.Where("zone_code = ?", caf.ZoneCode).First(&config).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", fmt.Errorf("%w: %s", ErrNoZoneConfig, caf.ZoneCode)
+	}
+	if err != nil {
+		return "", err
+	}
+	if config.Mode(target) == "" {
+		return "", fmt.Errorf("%w: no %s mode in zone %s", ErrNoZoneConfig, target, caf.ZoneCode)
+	}
+	return config.Mode(target), nil
 }
 
 // ===== STEP 3: Pre-activation =====
 func (s *OnboardingService) Step3PreActivation(cafRefNo string) error {
-	var caf Caf
-	s.DB.Where("caf_ref_no = ?", cafRefNo).First(&caf)
+	caf, err := s.findCaf(cafRefNo)
+	if err != nil {
+		return err
+	}
 
-	var config ZoneConfig
-	s.DB.Where("zone_code = ?", caf.ZoneCode).First(&config)
+	mode, err := s.stepMode(caf, "PREACT")
+	if err != nil {
+		return err
+	}
 
 	corrID := fmt.Sprintf("PRE-%s-%d", cafRefNo, time.Now().UnixNano())
 	payload := map[string]interface{}{
@@ -155,18 +375,17 @@ func (s *OnboardingService) Step3PreActivation(cafRefNo string) error {
 	outbox := IntegrationOutbox{
 		CafID:         caf.ID,
 		Target:        "PREACT",
-		Mode:          config.PreactMode,
+		Mode:          mode,
 		CorrelationID: corrID,
 		Payload:       string(payloadJSON),
 		Status:        "PENDING",
 	}
 
-	caf.Status = "PREACT_SENT"
-	caf.CurrentStep = 3
-
 	return s.DB.Transaction(func(tx *gorm.DB) error {
-		tx.Create(&outbox)
-		return tx.Save(&caf).Error
+		if err := s.transition(tx, &caf, StatusPreactSent); err != nil {
+			return err
+		}
+		return tx.Create(&outbox).Error
 	})
 }
 
@@ -182,34 +401,41 @@ func (s *OnboardingService) getIMSI(caf Caf) string {
 
 // ===== STEP 4: Pre-activation ACK =====
 func (s *OnboardingService) Step4PreActivationAck(corrID, ackStatus, cafRefNo string) error {
-	var outbox IntegrationOutbox
-	s.DB.Where("correlation_id = ? AND target = ?", corrID, "PREACT").First(&outbox)
-	outbox.Status = "ACKED"
-
-	var caf Caf
-	s.DB.Where("caf_ref_no = ?", cafRefNo).First(&caf)
+	outbox, caf, err := s.resolveAck(corrID, cafRefNo, "PREACT")
+	if err != nil {
+		return err
+	}
+	if cancelled, err := s.ackCancelled(outbox, caf, ackStatus); cancelled || err != nil {
+		return err
+	}
 
-	if ackStatus == "SUCCESS" {
-		caf.Status = "PREACT_DONE"
-		caf.CurrentStep = 4
-	} else {
-		caf.Status = "PREACT_FAILED"
-		caf.CurrentStep = 0
+	status := StatusPreactDone
+	if ackStatus != "SUCCESS" {
+		status = StatusPreactFailed
 	}
 
-	return s.DB.Transaction(func(tx *gorm.DB) error {
-		tx.Save(&outbox)
-		return tx.Save(&caf).Error
+	return s.inTx(func(s *OnboardingService) error {
+		if err := s.transition(s.DB, &caf, status); err != nil {
+			return err
+		}
+		if err := ackOutbox(s.DB, corrID); err != nil || status != StatusPreactDone {
+			return err
+		}
+		return s.signalAck(caf.CafRefNo, "PREACT", corrID, ackStatus)
 	})
 }
 
 // ===== STEP 5-6: Televerification =====
 func (s *OnboardingService) Step5TeleVerification(cafRefNo string) error {
-	var caf Caf
-	s.DB.Where("caf_ref_no = ?", cafRefNo).First(&caf)
+	caf, err := s.findCaf(cafRefNo)
+	if err != nil {
+		return err
+	}
 
-	var config ZoneConfig
-	s.DB.Where("zone_code = ?", caf.ZoneCode).First(&config)
+	mode, err := s.stepMode(caf, "TV")
+	if err != nil {
+		return err
+	}
 
 	corrID := fmt.Sprintf("TV-%s-%d", cafRefNo, time.Now().UnixNano())
 	payload := map[string]interface{}{
@@ -221,43 +447,58 @@ func (s *OnboardingService) Step5TeleVerification(cafRefNo string) error {
 	outbox := IntegrationOutbox{
 		CafID:         caf.ID,
 		Target:        "TV",
-		Mode:          config.TvMode,
+		Mode:          mode,
 		CorrelationID: corrID,
 		Payload:       string(payloadJSON),
 		Status:        "PENDING",
 	}
 
-	caf.Status = "TV_SENT"
-	caf.CurrentStep = 5
-
 	return s.DB.Transaction(func(tx *gorm.DB) error {
-		tx.Create(&outbox)
-		return tx.Save(&caf).Error
+		if err := s.transition(tx, &caf, StatusTvSent); err != nil {
+			return err
+		}
+		return tx.Create(&outbox).Error
 	})
 }
 
 func (s *OnboardingService) Step6TeleVerificationAck(corrID, ackStatus, cafRefNo string) error {
-	var caf Caf
-	s.DB.Where("caf_ref_no = ?", cafRefNo).First(&caf)
-
-	if ackStatus == "SUCCESS" {
-		caf.Status = "TV_DONE"
-		caf.CurrentStep = 6
-	} else {
-		caf.Status = "TV_FAILED"
-		caf.CurrentStep = 0
+	outbox, caf, err := s.resolveAck(corrID, cafRefNo, "TV")
+	if err != nil {
+		return err
+	}
+	if cancelled, err := s.ackCancelled(outbox, caf, ackStatus); cancelled || err != nil {
+		return err
 	}
 
-	return s.DB.Save(&caf).Error
+	status := StatusTvDone
+	if ackStatus != "SUCCESS" {
+		status = StatusTvFailed
+	}
+	return s.inTx(func(s *OnboardingService) error {
+		if err := s.transition(s.DB, &caf, status); err != nil {
+			return err
+		}
+		if err := ackOutbox(s.DB, corrID); err != nil {
+			return err
+		}
+		if status == StatusTvFailed {
+			return s.compensateIfFinal(caf, "TV")
+		}
+		return s.signalAck(caf.CafRefNo, "TV", corrID, ackStatus)
+	})
 }
 
 // ===== STEP 7-8: Final Activation =====
 func (s *OnboardingService) Step7FinalActivation(cafRefNo string) error {
-	var caf Caf
-	s.DB.Where("caf_ref_no = ?", cafRefNo).First(&caf)
+	caf, err := s.findCaf(cafRefNo)
+	if err != nil {
+		return err
+	}
 
-	var config ZoneConfig
-	s.DB.Where("zone_code = ?", caf.ZoneCode).First(&config)
+	mode, err := s.stepMode(caf, "FINALACT")
+	if err != nil {
+		return err
+	}
 
 	corrID := fmt.Sprintf("FINAL-%s-%d", cafRefNo, time.Now().UnixNano())
 	payload := map[string]interface{}{
@@ -269,48 +510,62 @@ func (s *OnboardingService) Step7FinalActivation(cafRefNo string) error {
 	outbox := IntegrationOutbox{
 		CafID:         caf.ID,
 		Target:        "FINALACT",
-		Mode:          config.FinalactMode,
+		Mode:          mode,
 		CorrelationID: corrID,
 		Payload:       string(payloadJSON),
 		Status:        "PENDING",
 	}
 
-	caf.Status = "FINALACT_SENT"
-	caf.CurrentStep = 7
-
 	return s.DB.Transaction(func(tx *gorm.DB) error {
-		tx.Create(&outbox)
-		return tx.Save(&caf).Error
+		if err := s.transition(tx, &caf, StatusFinalactSent); err != nil {
+			return err
+		}
+		return tx.Create(&outbox).Error
 	})
 }
 
 func (s *OnboardingService) Step8FinalActivationAck(corrID, ackStatus, cafRefNo string) error {
-	var caf Caf
-	s.DB.Where("caf_ref_no = ?", cafRefNo).First(&caf)
+	outbox, caf, err := s.resolveAck(corrID, cafRefNo, "FINALACT")
+	if err != nil {
+		return err
+	}
+	if cancelled, err := s.ackCancelled(outbox, caf, ackStatus); cancelled || err != nil {
+		return err
+	}
 
-	if ackStatus == "SUCCESS" {
-		caf.Status = "FINALACT_DONE"
-		caf.CurrentStep = 8
-		return s.Step9SancharsoftCommission(cafRefNo)
+	status := StatusFinalactDone
+	if ackStatus != "SUCCESS" {
+		status = StatusFinalactFailed
 	}
-	caf.Status = "FINALACT_FAILED"
-	caf.CurrentStep = 0
-	return s.DB.Save(&caf).Error
+	return s.inTx(func(s *OnboardingService) error {
+		if err := s.transition(s.DB, &caf, status); err != nil {
+			return err
+		}
+		if err := ackOutbox(s.DB, corrID); err != nil {
+			return err
+		}
+		if status == StatusFinalactFailed {
+			return s.compensateIfFinal(caf, "FINALACT")
+		}
+		return s.signalAck(caf.CafRefNo, "FINALACT", corrID, ackStatus)
+	})
 }
 
 // ===== STEP 9: Sancharsoft Commission =====
 func (s *OnboardingService) Step9SancharsoftCommission(cafRefNo string) error {
-	var caf Caf
-	s.DB.Where("caf_ref_no = ?", cafRefNo).First(&caf)
+	caf, err := s.findCaf(cafRefNo)
+	if err != nil {
+		return err
+	}
 
 	if !caf.IsAgent {
-		caf.Status = "COMPLETED"
-		caf.CurrentStep = 9
-		return s.DB.Save(&caf).Error
+		return s.transition(s.DB, &caf, StatusCompleted)
 	}
 
-	var config ZoneConfig
-	s.DB.Where("zone_code = ?", caf.ZoneCode).First(&config)
+	mode, err := s.stepMode(caf, "COMMISSION")
+	if err != nil {
+		return err
+	}
 
 	corrID := fmt.Sprintf("COMM-%s-%d", cafRefNo, time.Now().UnixNano())
 	payload := map[string]interface{}{
@@ -322,18 +577,48 @@ func (s *OnboardingService) Step9SancharsoftCommission(cafRefNo string) error {
 	outbox := IntegrationOutbox{
 		CafID:         caf.ID,
 		Target:        "COMMISSION",
-		Mode:          config.CommissionMode,
+		Mode:          mode,
 		CorrelationID: corrID,
 		Payload:       string(payloadJSON),
 		Status:        "PENDING",
 	}
 
-	caf.Status = "COMMISSION_SENT"
-	caf.CurrentStep = 9
-
 	return s.DB.Transaction(func(tx *gorm.DB) error {
-		tx.Create(&outbox)
-		return tx.Save(&caf).Error
+		if err := s.transition(tx, &caf, StatusCommissionSent); err != nil {
+			return err
+		}
+		return tx.Create(&outbox).Error
+	})
+}
+
+// ===== STEP 10: Commission ACK =====
+func (s *OnboardingService) Step10CommissionAck(corrID, ackStatus, cafRefNo string) error {
+	outbox, caf, err := s.resolveAck(corrID, cafRefNo, "COMMISSION")
+	if err != nil {
+		return err
+	}
+	if cancelled, err := s.ackCancelled(outbox, caf, ackStatus); cancelled || err != nil {
+		return err
+	}
+
+	status := StatusCompleted
+	if ackStatus != "SUCCESS" {
+		status = StatusCommissionFailed
+	}
+	return s.inTx(func(s *OnboardingService) error {
+		if err := s.transition(s.DB, &caf, status); err != nil {
+			return err
+		}
+		if err := ackOutbox(s.DB, corrID); err != nil || status == StatusCompleted {
+			return err
+		}
+		// The SIM is already active: a refused commission is retried or
+		// escalated, never reversed
+		left, err := s.retriesLeft(caf, "COMMISSION")
+		if err != nil || left > 0 {
+			return err
+		}
+		return s.escalate(caf, outbox)
 	})
 }
 
@@ -342,6 +627,33 @@ type Handler struct {
 	service *OnboardingService
 }
 
+// stepError writes err from a StepN call with the matching HTTP status.
+func stepError(c *gin.Context, err error) {
+	var te *TransitionError
+	switch {
+	case errors.As(err, &te):
+		c.JSON(409, gin.H{"error": err.Error(), "from": te.From, "to": te.To})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(404, gin.H{"error": "CAF not found"})
+	case errors.Is(err, ErrUnknownCorrelation):
+		c.JSON(404, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrTargetMismatch), errors.Is(err, ErrCafMismatch), errors.Is(err, ErrStaleCorrelation):
+		c.JSON(409, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrNoProcessInstance):
+		c.JSON(404, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrNotWaiting):
+		c.JSON(409, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrNoZoneConfig):
+		c.JSON(409, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrNoNextStep):
+		c.JSON(400, gin.H{"error": "No next step available"})
+	case errors.Is(err, ErrNotRetryable), errors.Is(err, ErrRetryLimitReached), errors.Is(err, ErrNotCancellable), errors.Is(err, ErrOutboxLeased):
+		c.JSON(409, gin.H{"error": err.Error()})
+	default:
+		c.JSON(500, gin.H{"error": err.Error()})
+	}
+}
+
 func (h *Handler) CSCApproval(c *gin.Context) {
 	var req struct {
 		Approved bool   `json:"approved"`
@@ -355,7 +667,7 @@ func (h *Handler) CSCApproval(c *gin.Context) {
 	}
 
 	if err := h.service.Step2CSCApproval(cafRefNo, req.Approved, req.User); err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		stepError(c, err)
 		return
 	}
 
@@ -364,24 +676,70 @@ func (h *Handler) CSCApproval(c *gin.Context) {
 
 func (h *Handler) NextStep(c *gin.Context) {
 	cafRefNo := c.Param("caf_ref_no")
-	
-	var caf Caf
-	h.service.DB.Where("caf_ref_no = ?", cafRefNo).First(&caf)
-
-	switch caf.CurrentStep {
-	case 2: // After approval
-		h.service.Step3PreActivation(cafRefNo)
-	case 4: // After preact
-		h.service.Step5TeleVerification(cafRefNo)
-	case 6: // After TV
-		h.service.Step7FinalActivation(cafRefNo)
-	default:
-		c.JSON(400, gin.H{"error": "No next step available"})
+
+	if err := h.service.NextStep(cafRefNo); err != nil {
+		stepError(c, err)
 		return
 	}
 	c.JSON(200, gin.H{"message": "Next step triggered"})
 }
 
+func (h *Handler) Retry(c *gin.Context) {
+	var req struct {
+		User string `json:"user"`
+	}
+	cafRefNo := c.Param("caf_ref_no")
+
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := h.service.RetryStep(cafRefNo, req.User); err != nil {
+		stepError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Step retried", "caf_ref_no": cafRefNo})
+}
+
+func (h *Handler) Cancel(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason" binding:"required"`
+		User   string `json:"user"`
+	}
+	cafRefNo := c.Param("caf_ref_no")
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.service.CancelCAF(cafRefNo, req.Reason, req.User); err != nil {
+		stepError(c, err)
+		return
+	}
+
+	caf, _ := h.service.findCaf(cafRefNo)
+	c.JSON(200, gin.H{"message": "CAF cancelled", "caf_ref_no": cafRefNo, "status": caf.Status})
+}
+
+// ackError writes err from an ACK step like stepError, first keeping an ACK
+// refused as stale as an OrphanCallback.
+func (h *Handler) ackError(c *gin.Context, corrID, ackStatus string, err error) {
+	if errors.Is(err, ErrStaleCorrelation) {
+		h.service.recordOrphan(OrphanCallback{
+			CorrelationID: corrID,
+			Reason:        OrphanStale,
+			Source:        c.Request.Method + " " + c.FullPath(),
+			AckStatus:     ackStatus,
+			RemoteAddr:    c.ClientIP(),
+		})
+	}
+	stepError(c, err)
+}
+
 func (h *Handler) PreActivationAck(c *gin.Context) {
 	corrID := c.Param("corr_id")
 	var req struct {
@@ -392,7 +750,10 @@ func (h *Handler) PreActivationAck(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	h.service.Step4PreActivationAck(corrID, req.AckStatus, req.CafRefNo)
+	if err := h.service.Step4PreActivationAck(corrID, req.AckStatus, req.CafRefNo); err != nil {
+		h.ackError(c, corrID, req.AckStatus, err)
+		return
+	}
 	c.JSON(200, gin.H{"message": "Pre-activation ACK received"})
 }
 
@@ -406,7 +767,10 @@ func (h *Handler) TeleVerificationAck(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	h.service.Step6TeleVerificationAck(corrID, req.AckStatus, req.CafRefNo)
+	if err := h.service.Step6TeleVerificationAck(corrID, req.AckStatus, req.CafRefNo); err != nil {
+		h.ackError(c, corrID, req.AckStatus, err)
+		return
+	}
 	c.JSON(200, gin.H{"message": "TV ACK received"})
 }
 
@@ -420,17 +784,346 @@ func (h *Handler) FinalActivationAck(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	h.service.Step8FinalActivationAck(corrID, req.AckStatus, req.CafRefNo)
+	if err := h.service.Step8FinalActivationAck(corrID, req.AckStatus, req.CafRefNo); err != nil {
+		h.ackError(c, corrID, req.AckStatus, err)
+		return
+	}
 	c.JSON(200, gin.H{"message": "Final activation ACK received"})
 }
 
+func (h *Handler) CommissionAck(c *gin.Context) {
+	corrID := c.Param("corr_id")
+	var req struct {
+		CafRefNo  string `json:"caf_ref_no"`
+		AckStatus string `json:"ack_status"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.service.Step10CommissionAck(corrID, req.AckStatus, req.CafRefNo); err != nil {
+		h.ackError(c, corrID, req.AckStatus, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Commission ACK received"})
+}
+
+func (h *Handler) RollbackAck(c *gin.Context) {
+	corrID := c.Param("corr_id")
+	var req struct {
+		AckStatus string `json:"ack_status"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.service.RollbackAck(corrID, req.AckStatus); err != nil {
+		h.ackError(c, corrID, req.AckStatus, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Rollback ACK received"})
+}
+
+func (h *Handler) ListOrphanCallbacks(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(400, gin.H{"error": "limit must be a positive number"})
+		return
+	}
+	rows, err := h.service.ListOrphanCallbacks(c.Query("correlation_id"), limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, rows)
+}
+
+func (h *Handler) ListQuarantine(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(400, gin.H{"error": "limit must be a positive number"})
+		return
+	}
+	rows, err := h.service.ListQuarantine(c.Query("status"), limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, rows)
+}
+
+func (h *Handler) FixQuarantined(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid id"})
+		return
+	}
+	var req struct {
+		Payload json.RawMessage `json:"payload" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	row, err := h.service.FixQuarantined(uint(id), req.Payload, adminOperator(c))
+	if err != nil {
+		quarantineError(c, err)
+		return
+	}
+	c.JSON(200, row)
+}
+
+func (h *Handler) ReplayQuarantined(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid id"})
+		return
+	}
+
+	row, err := h.service.ReplayQuarantined(uint(id))
+	if err != nil {
+		quarantineError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Message replayed", "quarantine": row})
+}
+
+// quarantineError writes err from a quarantine call with the matching HTTP
+// status.
+func quarantineError(c *gin.Context, err error) {
+	var verr *ValidationError
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(404, gin.H{"error": "Quarantined message not found"})
+	case errors.Is(err, ErrAlreadyReplayed):
+		c.JSON(409, gin.H{"error": err.Error()})
+	case errors.As(err, &verr):
+		c.JSON(422, gin.H{"error": err.Error(), "fields": verr.Fields})
+	default:
+		stepError(c, err)
+	}
+}
+
+func (h *Handler) ListOutbox(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(400, gin.H{"error": "limit must be a positive number"})
+		return
+	}
+	olderThan, ok := queryDuration(c, "older_than")
+	if !ok {
+		return
+	}
+	newerThan, ok := queryDuration(c, "newer_than")
+	if !ok {
+		return
+	}
+
+	rows, err := h.service.ListOutbox(OutboxFilter{
+		Target:    c.Query("target"),
+		Mode:      c.Query("mode"),
+		Status:    c.Query("status"),
+		ZoneCode:  c.Query("zone"),
+		OlderThan: olderThan,
+		NewerThan: newerThan,
+		Limit:     limit,
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, rows)
+}
+
+func (h *Handler) GetOutbox(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid id"})
+		return
+	}
+
+	row, attempts, err := h.service.GetOutbox(uint(id))
+	if err != nil {
+		outboxError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"outbox": row, "attempts": attempts})
+}
+
+func (h *Handler) RequeueOutbox(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid id"})
+		return
+	}
+
+	row, err := h.service.RequeueOutbox(uint(id), adminOperator(c))
+	if err != nil {
+		outboxError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Outbox row requeued", "outbox": row})
+}
+
+func (h *Handler) CancelOutbox(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid id"})
+		return
+	}
+	var req struct {
+		Reason string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	row, err := h.service.CancelOutbox(uint(id), req.Reason, adminOperator(c))
+	if err != nil {
+		outboxError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Outbox row cancelled", "outbox": row})
+}
+
+func (h *Handler) ListPartnerKeys(c *gin.Context) {
+	keys, err := h.service.ListPartnerKeys(c.Query("zone"), c.Query("partner"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, keys)
+}
+
+func (h *Handler) AddPartnerKey(c *gin.Context) {
+	var req struct {
+		ZoneCode   string     `json:"zone_code" binding:"required"`
+		Partner    string     `json:"partner" binding:"required"`
+		KeyID      string     `json:"key_id" binding:"required"`
+		Secret     string     `json:"secret"` // generated if empty
+		ActiveFrom time.Time  `json:"active_from"`
+		ExpiresAt  *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := deliveryFailedStatuses[req.Partner]; !ok || isRollbackTarget(req.Partner) {
+		c.JSON(400, gin.H{"error": "partner must be PREACT, TV, FINALACT or COMMISSION"})
+		return
+	}
+
+	key, err := h.service.AddPartnerKey(PartnerKey{
+		ZoneCode:   req.ZoneCode,
+		Partner:    req.Partner,
+		KeyID:      req.KeyID,
+		Secret:     req.Secret,
+		ActiveFrom: req.ActiveFrom,
+		ExpiresAt:  req.ExpiresAt,
+	})
+	if errors.Is(err, ErrPartnerKeyExists) {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	// The only time the secret is returned
+	c.JSON(201, gin.H{"key": key, "secret": key.Secret})
+}
+
+func (h *Handler) ExpirePartnerKey(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid id"})
+		return
+	}
+	var req struct {
+		ExpiresAt *time.Time `json:"expires_at"` // now if empty
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	at := time.Now()
+	if req.ExpiresAt != nil {
+		at = *req.ExpiresAt
+	}
+
+	key, err := h.service.ExpirePartnerKey(uint(id), at)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "Partner key not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Partner key expires at " + at.Format(time.RFC3339), "key": key})
+}
+
+// queryDuration reads an optional duration query parameter such as 30m,
+// writing a 400 if it does not parse.
+func queryDuration(c *gin.Context, name string) (time.Duration, bool) {
+	v := c.Query(name)
+	if v == "" {
+		return 0, true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		c.JSON(400, gin.H{"error": name + " must be a duration such as 30m or 2h"})
+		return 0, false
+	}
+	return d, true
+}
+
+// outboxError writes err from an outbox admin call with the matching HTTP
+// status.
+func outboxError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(404, gin.H{"error": "Outbox row not found"})
+	case errors.Is(err, ErrNotRequeueable), errors.Is(err, ErrOutboxNotPending), errors.Is(err, ErrOutboxLeased):
+		c.JSON(409, gin.H{"error": err.Error()})
+	default:
+		stepError(c, err)
+	}
+}
+
 // ===== MAIN =====
 func main() {
 	service := NewOnboardingService()
 	handler := &Handler{service: service}
 
+	// Cancelled on SIGINT/SIGTERM to start a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dlqTopic := os.Getenv("CAF_DLQ_TOPIC")
+	if dlqTopic == "" {
+		dlqTopic = "caf-topic-dlq"
+	}
+	service.DeadLetter = &kafka.Writer{
+		Addr:                   kafka.TCP("localhost:9092"),
+		Topic:                  dlqTopic,
+		AllowAutoTopicCreation: true,
+	}
+	defer service.DeadLetter.Close()
+
+	// CAFs in flight from before the process engine have no instance yet
+	if n, err := service.BackfillProcesses(); err != nil {
+		log.Printf("Process backfill failed: %v", err)
+	} else if n > 0 {
+		log.Printf("Started process instances for %d in-flight CAFs", n)
+	}
+
 	// Kafka Consumer (background)
+	consumerDone := make(chan struct{})
 	go func() {
+		defer close(consumerDone)
 		r := kafka.NewReader(kafka.ReaderConfig{
 			Brokers:  []string{"localhost:9092"},
 			Topic:    "caf-topic",
@@ -440,37 +1133,137 @@ func main() {
 		})
 		defer r.Close()
 
-		for {
-			msg, err := r.ReadMessage(context.Background())
-			if err != nil {
-				log.Println("Kafka error:", err)
-				continue
-			}
+		service.RunCAFConsumer(ctx, r, ConsumerConfig{
+			Workers:     envInt("CAF_CONSUMER_WORKERS", defaultConsumerWorkers),
+			MaxInFlight: envInt("CAF_CONSUMER_MAX_IN_FLIGHT", defaultConsumerMaxInFlight),
+			MaxAttempts: envInt("CAF_CONSUMER_MAX_ATTEMPTS", defaultConsumerMaxAttempts),
+		})
+	}()
 
-			var cafData map[string]interface{}
-			json.Unmarshal(msg.Value, &cafData)
-			if err := service.Step1ProcessKafkaCAF(cafData); err != nil {
-				log.Printf("CAF processing failed: %v", err)
-			} else {
-				log.Printf("✅ Step 1 COMPLETE: CAF %s -> PENDING_APPROVAL", cafData["caf_ref_no"])
-			}
+	// CAF lifecycle event relay (background)
+	eventsTopic := os.Getenv("CAF_EVENTS_TOPIC")
+	if eventsTopic == "" {
+		eventsTopic = "caf-events"
+	}
+	events := &kafka.Writer{
+		Addr:                   kafka.TCP("localhost:9092"),
+		Topic:                  eventsTopic,
+		Balancer:               &kafka.Hash{},
+		AllowAutoTopicCreation: true,
+	}
+	defer events.Close()
+	go service.RunEventRelay(ctx, events, 2*time.Second)
+
+	// Partner integrations (background)
+	dispatcher := NewOutboxDispatcher(service, nil)
+	if dsn := os.Getenv("PARTNER_DB_DSN"); dsn != "" {
+		// DBLINK zones exchange requests and responses through the partner database
+		partnerDB, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		if err != nil {
+			log.Fatal("Failed to connect partner database:", err)
 		}
-	}()
+		dispatcher.Senders["DBLINK"] = DBLinkSender{DB: partnerDB}
+		responses := &DBLinkResponses{Service: service, DB: partnerDB, DSN: dsn}
+		go responses.Run(ctx, 5*time.Second)
+	}
+	go dispatcher.Run(ctx, 2*time.Second)
+
+	// ACK deadline sweeper (background)
+	go service.RunAckTimeoutSweeper(ctx, 30*time.Second)
+
+	// Idempotency key cleanup (background)
+	go RunIdempotencyCleanup(ctx, GormIdempotencyStore{DB: service.DB}, defaultIdempotencyTTL, time.Hour)
+
+	// Flowable external workers (background)
+	if flowable, ok := service.Engine.(*FlowableWorkflow); ok {
+		go flowable.RunWorkers(ctx, 5*time.Second)
+	}
 
 	// HTTP Server
 	r := gin.Default()
-	r.GET("/health", func(c *gin.Context) { c.JSON(200, gin.H{"status": "OK"}) })
-	r.GET("/caf/:caf_ref_no", func(c *gin.Context) {
+	r.GET("/health", func(c *gin.Context) {
+		// A circuit that is not closed degrades a partner integration, and
+		// probes see it as a 503
+		status, code := "OK", 200
+		circuits := dispatcher.Breakers.States()
+		for _, circuit := range circuits {
+			if circuit.State != CircuitClosed {
+				status, code = "DEGRADED", 503
+			}
+		}
+		c.JSON(code, gin.H{"status": status, "circuits": circuits})
+	})
+	idempotent := IdempotencyMiddleware(GormIdempotencyStore{DB: service.DB})
+	cafRoutes := r.Group("/caf", idempotent)
+	cafRoutes.GET("/:caf_ref_no", func(c *gin.Context) {
 		var caf Caf
 		service.DB.Where("caf_ref_no = ?", c.Param("caf_ref_no")).First(&caf)
 		c.JSON(200, caf)
 	})
-	r.POST("/caf/:caf_ref_no/approve", handler.CSCApproval)
-	r.POST("/caf/:caf_ref_no/next", handler.NextStep)
-	r.POST("/callback/preact/:corr_id", handler.PreActivationAck)
-	r.POST("/callback/tv/:corr_id", handler.TeleVerificationAck)
-	r.POST("/callback/final/:corr_id", handler.FinalActivationAck)
-
-	log.Println("🚀 Server starting on :3000")
-	r.Run(":3000")
+	cafRoutes.POST("/:caf_ref_no/approve", handler.CSCApproval)
+	cafRoutes.POST("/:caf_ref_no/next", handler.NextStep)
+	cafRoutes.POST("/:caf_ref_no/retry", handler.Retry)
+	cafRoutes.POST("/:caf_ref_no/cancel", handler.Cancel)
+	callbacks := r.Group("/callback", CallbackSignature(service, defaultReplayWindow), idempotent)
+	callbacks.POST("/preact/:corr_id", handler.PreActivationAck)
+	callbacks.POST("/tv/:corr_id", handler.TeleVerificationAck)
+	callbacks.POST("/final/:corr_id", handler.FinalActivationAck)
+	callbacks.POST("/commission/:corr_id", handler.CommissionAck)
+	callbacks.POST("/rollback/:corr_id", handler.RollbackAck)
+
+	// Operator API, behind a bearer token. Its responses, such as a new
+	// partner key's secret, are never stored for idempotent replay.
+	adminTokens := parseAdminTokens(os.Getenv("ADMIN_TOKENS"))
+	if len(adminTokens) == 0 {
+		log.Println("ADMIN_TOKENS is not set: the /admin API is disabled")
+	}
+	admin := r.Group("/admin", AdminAuth(adminTokens))
+	admin.GET("/quarantine", handler.ListQuarantine)
+	admin.PUT("/quarantine/:id", handler.FixQuarantined)
+	admin.POST("/quarantine/:id/replay", handler.ReplayQuarantined)
+	admin.GET("/outbox", handler.ListOutbox)
+	admin.GET("/outbox/metrics", func(c *gin.Context) {
+		depth, err := service.OutboxQueueDepth()
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"queue": depth, "dispatch": dispatcher.Stats(), "circuits": dispatcher.Breakers.States()})
+	})
+	admin.GET("/outbox/:id", handler.GetOutbox)
+	admin.POST("/outbox/:id/requeue", handler.RequeueOutbox)
+	admin.POST("/outbox/:id/cancel", handler.CancelOutbox)
+	admin.GET("/orphan-callbacks", handler.ListOrphanCallbacks)
+	admin.GET("/partner-keys", handler.ListPartnerKeys)
+	admin.POST("/partner-keys", handler.AddPartnerKey)
+	admin.POST("/partner-keys/:id/expire", handler.ExpirePartnerKey)
+
+	srv := &http.Server{Addr: ":3000", Handler: r}
+	go func() {
+		log.Println("🚀 Server starting on :3000")
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Server failed:", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down: draining HTTP requests and Kafka consumer")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
+	}
+	select {
+	case <-consumerDone:
+	case <-shutdownCtx.Done():
+		log.Println("Kafka consumer did not drain in time")
+	}
+}
+
+// envInt reads a positive integer setting from the environment.
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
 }
\ No newline at end of file
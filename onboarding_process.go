@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// ErrUnknownOperation is returned for an integrationService task whose
+// operation field has no matching step.
+var ErrUnknownOperation = errors.New("unknown integrationService operation")
+
+// processKey is the id of the process in flowable-bpmn.xml.
+const processKey = "customerOnboardingProcess"
+
+// operationTargets maps the operation field of each integrationService task
+// to the outbox target its step sends to.
+var operationTargets = map[string]string{
+	"PRE_ACTIVATION":        "PREACT",
+	"TELE_VERIFICATION":     "TV",
+	"FINAL_ACTIVATION":      "FINALACT",
+	"COMMISSION_SETTLEMENT": "COMMISSION",
+}
+
+// waitOperations maps each outbox target to the operation field of the
+// callbackService task that waits for its ACK.
+var waitOperations = map[string]string{
+	"PREACT":   "WAIT_PRE_ACTIVATION",
+	"TV":       "WAIT_TELE_VER",
+	"FINALACT": "WAIT_FINAL_ACTIVATION",
+}
+
+// backfillActivities maps each status a CAF can be in part way through
+// onboarding to the activity its process instance would be on.
+var backfillActivities = map[string]string{
+	StatusApproved:          "PRE_ACTIVATION",
+	StatusPreactSent:        "WAIT_PRE_ACTIVATION",
+	StatusPreactFailed:      "WAIT_PRE_ACTIVATION",
+	StatusPreactTimeout:     "WAIT_PRE_ACTIVATION",
+	StatusPreactDone:        "TELE_VERIFICATION",
+	StatusTvSent:            "WAIT_TELE_VER",
+	StatusTvFailed:          "WAIT_TELE_VER",
+	StatusTvTimeout:         "WAIT_TELE_VER",
+	StatusTvDone:            "FINAL_ACTIVATION",
+	StatusFinalactSent:      "WAIT_FINAL_ACTIVATION",
+	StatusFinalactFailed:    "WAIT_FINAL_ACTIVATION",
+	StatusFinalactTimeout:   "WAIT_FINAL_ACTIVATION",
+	StatusFinalactDone:      "COMMISSION_SETTLEMENT",
+	StatusCommissionSent:    "COMMISSION_SETTLEMENT",
+	StatusCommissionFailed:  "COMMISSION_SETTLEMENT",
+	StatusCommissionTimeout: "COMMISSION_SETTLEMENT",
+}
+
+// processDelegates binds the delegateExpressions in flowable-bpmn.xml to
+// OnboardingService.
+func (s *OnboardingService) processDelegates() map[string]Delegate {
+	return map[string]Delegate{
+		"cafValidationService": func(ctx *TaskContext) (interface{}, error) {
+			caf, err := s.findCaf(ctx.CafRefNo)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"status": caf.Status, "imsi": s.getIMSI(caf)}, nil
+		},
+
+		// integrationService runs the step named by the task's operation
+		// field. Unless the zone auto-advances to that step, or an operator
+		// resumed the task through NextStep, the instance parks first.
+		"integrationService": func(ctx *TaskContext) (interface{}, error) {
+			target := operationTargets[ctx.Node.Fields["operation"]]
+			step := cafSendSteps[target]
+			if step == nil {
+				return nil, ErrUnknownOperation
+			}
+
+			caf, err := s.findCaf(ctx.CafRefNo)
+			if err != nil {
+				return nil, err
+			}
+			if caf.CurrentStep >= sentStep(target) {
+				return map[string]interface{}{"status": caf.Status}, nil
+			}
+			if !ctx.Resumed && !s.autoAdvance(caf, target) {
+				return nil, ErrWaitForResume
+			}
+
+			if err := step(s, ctx.CafRefNo); err != nil {
+				return nil, err
+			}
+			caf, err = s.findCaf(ctx.CafRefNo)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"status": caf.Status}, nil
+		},
+
+		// callbackService waits until the partner ACK for the step signals
+		// the task.
+		"callbackService": func(ctx *TaskContext) (interface{}, error) {
+			return nil, ErrWaitForSignal
+		},
+	}
+}
+
+// flowableDelegates are the process delegates run by the external workers of
+// a FlowableWorkflow. Flowable cannot be signalled on a service task, so
+// callbackService completes once the CAF's status shows the step's ACK.
+func (s *OnboardingService) flowableDelegates() map[string]Delegate {
+	delegates := s.processDelegates()
+	delegates["callbackService"] = func(ctx *TaskContext) (interface{}, error) {
+		var target string
+		for t, op := range waitOperations {
+			if op == ctx.Node.Fields["operation"] {
+				target = t
+			}
+		}
+		if target == "" {
+			return nil, ErrUnknownOperation
+		}
+
+		caf, err := s.findCaf(ctx.CafRefNo)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case caf.CurrentStep > sentStep(target):
+			return map[string]interface{}{"status": "SUCCESS"}, nil
+		case caf.CurrentStep == 0:
+			// rejected, cancelled, failed or being rolled back
+			return map[string]interface{}{"status": "FAILED"}, nil
+		}
+		return nil, ErrWaitForSignal
+	}
+	return delegates
+}
+
+// sentStep is the CurrentStep of a CAF waiting on target's ACK.
+func sentStep(target string) int {
+	for status, t := range cafSentTargets {
+		if t == target {
+			return cafStatusStep[status]
+		}
+	}
+	return 0
+}
+
+// startProcess starts the CAF's process instance.
+func (s *OnboardingService) startProcess(caf Caf) error {
+	return s.Engine.Start(caf.CafRefNo, processVariables(caf))
+}
+
+// processVariables are the variables a CAF's process instance starts with.
+func processVariables(caf Caf) map[string]interface{} {
+	return map[string]interface{}{
+		"cafId":    strconv.FormatUint(uint64(caf.ID), 10),
+		"cafRefNo": caf.CafRefNo,
+		"zoneCode": caf.ZoneCode,
+		"isAgent":  caf.IsAgent,
+	}
+}
+
+// BackfillProcesses starts a process instance for every CAF in flight that
+// has none, such as those received before the process engine was deployed.
+// CAFs awaiting approval start from the beginning. CAFs past approval are
+// placed on the activity matching their status, which only the in-process
+// engine can do; on Flowable they are left to be started there by hand.
+func (s *OnboardingService) BackfillProcesses() (int, error) {
+	engine, inProcess := s.Engine.(*ProcessEngine)
+	statuses := []string{StatusPendingApproval}
+	if inProcess {
+		for status := range backfillActivities {
+			statuses = append(statuses, status)
+		}
+	}
+
+	q := s.DB.Where("status IN ?", statuses)
+	if inProcess {
+		q = q.Where("caf_ref_no NOT IN (?)", s.DB.Model(&ProcessInstance{}).Select("caf_ref_no"))
+	}
+	var cafs []Caf
+	if err := q.Order("id").Find(&cafs).Error; err != nil {
+		return 0, err
+	}
+
+	started := 0
+	for _, caf := range cafs {
+		var err error
+		if caf.Status == StatusPendingApproval {
+			// Start does nothing for a CAF Flowable already has an instance of
+			err = s.startProcess(caf)
+		} else {
+			err = engine.StartAt(caf.CafRefNo, backfillActivities[caf.Status], processVariables(caf))
+		}
+		var taskErr *TaskError
+		if err != nil && !errors.As(err, &taskErr) {
+			log.Printf("Process backfill for CAF %s failed: %v", caf.CafRefNo, err)
+			continue
+		}
+		started++
+	}
+	return started, nil
+}
+
+// inTx calls fn with a copy of s whose database calls, and those of an
+// in-process engine and its delegates, all run in one transaction, so a CAF
+// status change and the process step it drives commit or roll back
+// together. A failing service task the engine ran on from there is not
+// rolled back: the instance stays parked on it, and the error is returned
+// after the commit.
+func (s *OnboardingService) inTx(fn func(s *OnboardingService) error) error {
+	var taskErr *TaskError
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		txs := *s
+		txs.DB = tx
+		if engine, ok := s.Engine.(*ProcessEngine); ok {
+			txEngine := &ProcessEngine{db: tx, def: engine.def}
+			txEngine.delegates = txs.processDelegates()
+			txs.Engine = txEngine
+		}
+
+		err := fn(&txs)
+		if errors.As(err, &taskErr) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if taskErr != nil {
+		return taskErr
+	}
+	return nil
+}
+
+// signalAck completes the process task waiting on target's ACK.
+func (s *OnboardingService) signalAck(cafRefNo, target, corrID, ackStatus string) error {
+	return s.Engine.Signal(cafRefNo, waitOperations[target], map[string]interface{}{
+		"status":         ackStatus,
+		"correlation_id": corrID,
+	}, nil)
+}
+
+// failAck completes the process task waiting on target's ACK with a final
+// failure, ending the instance if the process has no branch for it. Targets
+// the process does not wait on, such as COMMISSION, are left alone.
+func (s *OnboardingService) failAck(cafRefNo, target string) error {
+	if waitOperations[target] == "" {
+		return nil
+	}
+	return s.Engine.Fail(cafRefNo, waitOperations[target], map[string]interface{}{"status": "FAILED"})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrNotRequeueable is returned by RequeueOutbox for a row that is not
+	// FAILED or DEAD, or whose CAF is no longer waiting on its step.
+	ErrNotRequeueable = errors.New("outbox row cannot be requeued")
+	// ErrOutboxNotPending is returned by CancelOutbox for a row that is no
+	// longer PENDING.
+	ErrOutboxNotPending = errors.New("outbox row is not pending")
+	// ErrOutboxLeased is returned by CancelOutbox and CancelCAF for a row a
+	// dispatcher has claimed and may be sending.
+	ErrOutboxLeased = errors.New("outbox row is being sent")
+)
+
+// outboxSentStatuses maps each outbox target to the CAF status of a CAF
+// waiting on it.
+var outboxSentStatuses = map[string]string{
+	"PREACT":            StatusPreactSent,
+	"TV":                StatusTvSent,
+	"FINALACT":          StatusFinalactSent,
+	"COMMISSION":        StatusCommissionSent,
+	"PREACT_ROLLBACK":   StatusRollbackPending,
+	"FINALACT_ROLLBACK": StatusRollbackPending,
+}
+
+// OutboxFilter selects outbox rows for ListOutbox. Empty fields match
+// everything.
+type OutboxFilter struct {
+	Target    string
+	Mode      string
+	Status    string
+	ZoneCode  string
+	OlderThan time.Duration // created at least this long ago
+	NewerThan time.Duration // created at most this long ago
+	Limit     int
+}
+
+// ListOutbox returns outbox rows matching f, newest first.
+func (s *OnboardingService) ListOutbox(f OutboxFilter) ([]IntegrationOutbox, error) {
+	q := s.DB.Order("id DESC").Limit(f.Limit)
+	if f.Target != "" {
+		q = q.Where("target = ?", f.Target)
+	}
+	if f.Mode != "" {
+		q = q.Where("mode = ?", f.Mode)
+	}
+	if f.Status != "" {
+		q = q.Where("status = ?", f.Status)
+	}
+	if f.ZoneCode != "" {
+		q = q.Where("caf_id IN (?)", s.DB.Model(&Caf{}).Select("id").Where("zone_code = ?", f.ZoneCode))
+	}
+	now := time.Now()
+	if f.OlderThan > 0 {
+		q = q.Where("created_at <= ?", now.Add(-f.OlderThan))
+	}
+	if f.NewerThan > 0 {
+		q = q.Where("created_at >= ?", now.Add(-f.NewerThan))
+	}
+
+	var rows []IntegrationOutbox
+	return rows, q.Find(&rows).Error
+}
+
+// GetOutbox returns an outbox row with its delivery attempts, oldest first.
+func (s *OnboardingService) GetOutbox(id uint) (IntegrationOutbox, []OutboxAttempt, error) {
+	var row IntegrationOutbox
+	if err := s.DB.First(&row, id).Error; err != nil {
+		return row, nil, err
+	}
+	var attempts []OutboxAttempt
+	err := s.DB.Where("outbox_id = ?", id).Order("id").Find(&attempts).Error
+	return row, attempts, err
+}
+
+// RequeueOutbox sends a FAILED or DEAD row again, with a fresh set of
+// attempts. A CAF that was failed because the row could not be delivered
+// goes back to waiting on it.
+func (s *OnboardingService) RequeueOutbox(id uint, operator string) (IntegrationOutbox, error) {
+	var row IntegrationOutbox
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&row, id).Error; err != nil {
+			return err
+		}
+		if row.Status != "FAILED" && row.Status != "DEAD" {
+			return ErrNotRequeueable
+		}
+
+		var caf Caf
+		if err := tx.First(&caf, row.CafID).Error; err != nil {
+			return err
+		}
+		switch caf.Status {
+		case outboxSentStatuses[row.Target]:
+		case deliveryFailedStatuses[row.Target]:
+			if err := s.transition(tx, &caf, outboxSentStatuses[row.Target]); err != nil {
+				return err
+			}
+		default:
+			return ErrNotRequeueable
+		}
+
+		failedStatus := row.Status
+		row.Status = "PENDING"
+		row.Attempts = 0
+		row.NextAttemptAt = nil
+		if err := tx.Model(&row).Updates(map[string]interface{}{
+			"status":           row.Status,
+			"attempts":         row.Attempts,
+			"next_attempt_at":  nil,
+			"lease_owner":      "",
+			"lease_expires_at": nil,
+		}).Error; err != nil {
+			return err
+		}
+		return s.audit(tx, caf, "OUTBOX_REQUEUE", operator, map[string]interface{}{
+			"outbox_id":      row.ID,
+			"target":         row.Target,
+			"correlation_id": row.CorrelationID,
+			"was":            failedStatus,
+			"last_error":     row.LastError,
+		})
+	})
+	return row, err
+}
+
+// CancelOutbox stops a PENDING row from being sent. A row a dispatcher
+// holds a live lease on is refused, as its send may already be under way.
+// The CAF is left as it is; its ACK deadline still applies.
+func (s *OnboardingService) CancelOutbox(id uint, reason, operator string) (IntegrationOutbox, error) {
+	var row IntegrationOutbox
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&row, id).Error; err != nil {
+			return err
+		}
+		res := tx.Model(&IntegrationOutbox{}).Where("id = ? AND status = ?", id, "PENDING").
+			Where("lease_expires_at IS NULL OR lease_expires_at < now()").
+			Update("status", "CANCELLED")
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			if err := tx.First(&row, id).Error; err != nil {
+				return err
+			}
+			if row.Status == "PENDING" {
+				return ErrOutboxLeased
+			}
+			return ErrOutboxNotPending
+		}
+		row.Status = "CANCELLED"
+
+		var caf Caf
+		if err := tx.First(&caf, row.CafID).Error; err != nil {
+			return err
+		}
+		return s.audit(tx, caf, "OUTBOX_CANCEL", operator, map[string]interface{}{
+			"outbox_id":      row.ID,
+			"target":         row.Target,
+			"correlation_id": row.CorrelationID,
+			"reason":         reason,
+		})
+	})
+	return row, err
+}
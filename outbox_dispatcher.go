@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxPartnerResponse caps how much of a partner's reply is kept on the
+// outbox row.
+const maxPartnerResponse = 64 << 10
+
+// Delivery retry defaults for zones with no ZoneTargetConfig row for a
+// target.
+const (
+	defaultMaxAttempts = 5
+	defaultBackoffBase = 10 * time.Second
+	defaultBackoffMax  = 10 * time.Minute
+)
+
+const (
+	defaultLeaseDuration = 2 * time.Minute
+
+	// leaseMargin is kept between a send's deadline and the expiry of its
+	// lease, and is the least time left on a lease worth starting a send in.
+	leaseMargin = 10 * time.Second
+)
+
+// deliveryFailedStatuses maps each outbox target to the CAF status used when
+// its delivery is given up.
+var deliveryFailedStatuses = map[string]string{
+	"PREACT":            StatusPreactFailed,
+	"TV":                StatusTvFailed,
+	"FINALACT":          StatusFinalactFailed,
+	"COMMISSION":        StatusCommissionFailed,
+	"PREACT_ROLLBACK":   StatusRollbackFailed,
+	"FINALACT_ROLLBACK": StatusRollbackFailed,
+}
+
+// outboxOpenStatuses are the outbox statuses of a request a partner has not
+// answered yet.
+var outboxOpenStatuses = []string{"PENDING", "SENT"}
+
+// OutboxResult is a partner's synchronous reply to one delivery.
+type OutboxResult struct {
+	Code int
+	Body string
+}
+
+// OutboxAttempt is one delivery attempt of an IntegrationOutbox row.
+type OutboxAttempt struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	OutboxID     uint      `gorm:"index" json:"outbox_id"`
+	Attempt      int       `json:"attempt"`
+	Dispatcher   string    `json:"dispatcher"`
+	ResponseCode int       `json:"response_code,omitempty"`
+	Response     string    `json:"response,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	DurationMs   int64     `json:"duration_ms"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// OutboxSender delivers outbox rows in one integration mode.
+type OutboxSender interface {
+	// Send delivers row to the partner configured by config. A non-nil
+	// error means the partner did not accept it; result holds whatever
+	// reply there was.
+	Send(ctx context.Context, row IntegrationOutbox, config ZoneTargetConfig) (OutboxResult, error)
+}
+
+// OutboxDispatcher delivers PENDING IntegrationOutbox rows to partners,
+// using the sender registered for each row's mode.
+//
+// Rows are claimed in batches under a lease held by ID. Every send is
+// abandoned before the lease expires, so a row whose dispatcher crashed is
+// picked up again once its lease runs out, and a correlation ID is never
+// being sent by two dispatchers at once.
+//
+// Rows for a partner whose circuit is open, or that is at its zone's rate
+// or in-flight limit, are deferred without an attempt being counted.
+type OutboxDispatcher struct {
+	Service       *OnboardingService
+	Senders       map[string]OutboxSender // by IntegrationOutbox.Mode
+	Breakers      *CircuitBreakers
+	BatchSize     int
+	ID            string        // lease owner, unique per instance
+	LeaseDuration time.Duration // how long a claimed batch is reserved
+
+	counters dispatchCounters
+}
+
+// NewOutboxDispatcher returns a dispatcher that sends API mode rows with
+// httpClient.
+func NewOutboxDispatcher(s *OnboardingService, httpClient *http.Client) *OutboxDispatcher {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	host, _ := os.Hostname()
+	return &OutboxDispatcher{
+		Service:       s,
+		Senders:       map[string]OutboxSender{"API": APISender{HTTP: httpClient, DB: s.DB}},
+		Breakers:      NewCircuitBreakers(),
+		BatchSize:     50,
+		ID:            fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano()),
+		LeaseDuration: defaultLeaseDuration,
+	}
+}
+
+// Run calls Dispatch every interval until ctx is done.
+func (d *OutboxDispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := d.Dispatch(ctx); err != nil {
+				log.Printf("Outbox dispatch failed: %v", err)
+			}
+		}
+	}
+}
+
+// Dispatch claims up to BatchSize PENDING rows that are due, oldest first,
+// and sends them. Each attempt bumps the row's attempt count and stores the
+// partner's reply. A row the partner accepted is marked SENT. One it did
+// not is retried after a jittered exponential backoff until the zone's
+// MaxAttempts for the target have been made; it is then marked DEAD and its
+// CAF failed. Rows left unsent when the lease runs short are released, and
+// rows whose circuit is open or whose partner is throttled are put off
+// until they can be sent. So is a row whose config cannot be loaded, after
+// the default backoff.
+func (d *OutboxDispatcher) Dispatch(ctx context.Context) (int, error) {
+	claimedAt := time.Now()
+	rows, err := d.claim(ctx)
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+	// Measured from before the claim, so it passes before the lease does
+	deadline := claimedAt.Add(d.LeaseDuration - leaseMargin)
+
+	limits := &dispatchLimits{throttled: map[CircuitKey]int{}}
+	sent := 0
+	for i, row := range rows {
+		if ctx.Err() != nil || time.Until(deadline) < leaseMargin {
+			return sent, d.release(rows[i:])
+		}
+
+		config, err := d.rowConfig(row)
+		if err != nil {
+			// Not the partner's failure: try again later without using up
+			// an attempt
+			log.Printf("Outbox %s: loading its config failed, retrying later: %v", row.CorrelationID, err)
+			if err := d.deferRow(row, time.Now().Add(retryBackoff(row.Attempts+1, config))); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		key := CircuitKey{Target: row.Target, ZoneCode: config.ZoneCode, Mode: row.Mode}
+		if ok, retryAt := d.Breakers.Allow(key, config); !ok {
+			d.counters.add(key, func(s *DispatchStats) { s.CircuitDeferred++ })
+			if err := d.deferRow(row, retryAt); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		ok, retryAt, err := d.throttle(limits, row, key, config)
+		if err != nil || !ok {
+			d.Breakers.Release(key)
+			if err == nil {
+				err = d.deferRow(row, retryAt)
+			}
+			if err != nil {
+				return sent, err
+			}
+			continue
+		}
+
+		started := time.Now()
+		sendCtx, cancel := context.WithDeadline(ctx, deadline)
+		result, sendErr := d.Senders[row.Mode].Send(sendCtx, row, config)
+		cancel()
+		if ctx.Err() != nil {
+			// Shutting down: leave the row PENDING for the next run
+			return sent, d.release(rows[i:])
+		}
+		d.Breakers.Record(key, config, partnerFailure(result, sendErr))
+
+		if err := d.finish(&row, config, started, result, sendErr); err != nil {
+			return sent, err
+		}
+		if sendErr == nil {
+			sent++
+			d.counters.add(key, func(s *DispatchStats) { s.Sent++ })
+		} else {
+			d.counters.add(key, func(s *DispatchStats) { s.Failed++ })
+		}
+	}
+	return sent, nil
+}
+
+// claim leases a batch of due rows to this dispatcher. Rows locked by a
+// concurrent claim are skipped, and rows whose lease has expired are
+// claimed again. Lease times use the database clock.
+func (d *OutboxDispatcher) claim(ctx context.Context) ([]IntegrationOutbox, error) {
+	modes := make([]string, 0, len(d.Senders))
+	for mode := range d.Senders {
+		modes = append(modes, mode)
+	}
+
+	var rows []IntegrationOutbox
+	err := d.Service.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND mode IN ?", "PENDING", modes).
+			Where("next_attempt_at IS NULL OR next_attempt_at <= ?", time.Now()).
+			Where("lease_expires_at IS NULL OR lease_expires_at < now()").
+			Order("id").Limit(d.BatchSize).
+			Find(&rows).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(rows))
+		for i, row := range rows {
+			ids[i] = row.ID
+		}
+		return tx.Model(&IntegrationOutbox{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"lease_owner":      d.ID,
+			"lease_expires_at": gorm.Expr("now() + make_interval(secs => ?)", d.LeaseDuration.Seconds()),
+			"sending_since":    nil,
+		}).Error
+	})
+	return rows, err
+}
+
+// release gives up this dispatcher's lease on rows it has not sent.
+func (d *OutboxDispatcher) release(rows []IntegrationOutbox) error {
+	ids := make([]uint, len(rows))
+	for i, row := range rows {
+		ids[i] = row.ID
+	}
+	return d.Service.DB.Model(&IntegrationOutbox{}).
+		Where("id IN ? AND lease_owner = ?", ids, d.ID).
+		Updates(map[string]interface{}{"lease_owner": "", "lease_expires_at": nil, "sending_since": nil}).Error
+}
+
+// finish records an attempt on row, both on the row and as an
+// OutboxAttempt, and releases its lease. A row that was closed while it was
+// being sent, by an ACK or a cancel, keeps its status. A row that has just
+// been given up fails its CAF in the same transaction, see failDelivery.
+func (d *OutboxDispatcher) finish(row *IntegrationOutbox, config ZoneTargetConfig, started time.Time, result OutboxResult, sendErr error) error {
+	row.Attempts++
+	status := "SENT"
+	updates := map[string]interface{}{
+		"attempts":         row.Attempts,
+		"response_code":    result.Code,
+		"response":         result.Body,
+		"next_attempt_at":  nil,
+		"last_error":       "",
+		"lease_owner":      "",
+		"lease_expires_at": nil,
+		"sending_since":    nil,
+	}
+	switch {
+	case sendErr == nil:
+		updates["sent_at"] = time.Now()
+	case row.Attempts >= config.MaxAttempts:
+		log.Printf("Outbox %s (%s) DEAD after %d attempts: %v", row.CorrelationID, row.Target, row.Attempts, sendErr)
+		status = "DEAD"
+		updates["last_error"] = sendErr.Error()
+		row.LastError = sendErr.Error()
+	default:
+		delay := retryBackoff(row.Attempts, config)
+		log.Printf("Outbox %s (%s) attempt %d failed, retrying in %s: %v", row.CorrelationID, row.Target, row.Attempts, delay, sendErr)
+		status = "PENDING"
+		updates["next_attempt_at"] = time.Now().Add(delay)
+		updates["last_error"] = sendErr.Error()
+	}
+	updates["status"] = gorm.Expr("CASE WHEN status = ? THEN ? ELSE status END", "PENDING", status)
+
+	attempt := OutboxAttempt{
+		OutboxID:     row.ID,
+		Attempt:      row.Attempts,
+		Dispatcher:   d.ID,
+		ResponseCode: result.Code,
+		Response:     result.Body,
+		DurationMs:   time.Since(started).Milliseconds(),
+	}
+	if sendErr != nil {
+		attempt.Error = sendErr.Error()
+	}
+
+	leased := true
+	err := d.Service.inTx(func(s *OnboardingService) error {
+		res := s.DB.Model(&IntegrationOutbox{}).
+			Where("id = ? AND lease_owner = ?", row.ID, d.ID).
+			Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			leased = false
+			return nil
+		}
+		if err := s.DB.Create(&attempt).Error; err != nil || status != "DEAD" {
+			return err
+		}
+		return s.failDelivery(*row)
+	})
+	var taskErr *TaskError
+	if errors.As(err, &taskErr) {
+		// Committed: the process is parked on the failed task
+		log.Printf("Failing CAF %d after outbox %s went DEAD: %v", row.CafID, row.CorrelationID, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !leased {
+		log.Printf("Outbox %s: lease lost before the attempt was recorded", row.CorrelationID)
+	}
+	return nil
+}
+
+// deferRow releases row without an attempt, to be claimed again at retryAt.
+func (d *OutboxDispatcher) deferRow(row IntegrationOutbox, retryAt time.Time) error {
+	return d.Service.DB.Model(&IntegrationOutbox{}).
+		Where("id = ? AND lease_owner = ?", row.ID, d.ID).
+		Updates(map[string]interface{}{
+			"next_attempt_at":  retryAt,
+			"lease_owner":      "",
+			"lease_expires_at": nil,
+			"sending_since":    nil,
+		}).Error
+}
+
+// rowConfig returns the configuration of row's target in its CAF's zone.
+func (d *OutboxDispatcher) rowConfig(row IntegrationOutbox) (ZoneTargetConfig, error) {
+	var caf Caf
+	if err := d.Service.DB.Select("id", "zone_code").First(&caf, row.CafID).Error; err != nil {
+		return ZoneTargetConfig{}, fmt.Errorf("CAF %d: %w", row.CafID, err)
+	}
+	return d.Service.targetConfig(caf.ZoneCode, row.Target), nil
+}
+
+// retryBackoff is the delay after a row's attempts-th failed attempt:
+// BackoffBaseSec doubled for each earlier attempt, capped at BackoffMaxSec,
+// with up to half of it taken off at random so retries to one partner
+// spread out.
+func retryBackoff(attempts int, config ZoneTargetConfig) time.Duration {
+	base := time.Duration(config.BackoffBaseSec) * time.Second
+	max := time.Duration(config.BackoffMaxSec) * time.Second
+	if base <= 0 {
+		base = defaultBackoffBase
+	}
+	if max < base {
+		max = base
+	}
+
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// failDelivery records the last error of a DEAD outbox row on its CAF and
+// moves the CAF to the failed status of the row's step, then handles it
+// like a refused ACK. A CAF that has already moved on keeps its status. It
+// runs in finish's inTx, with the update that made the row DEAD.
+func (s *OnboardingService) failDelivery(row IntegrationOutbox) error {
+	var caf Caf
+	if err := s.DB.First(&caf, row.CafID).Error; err != nil {
+		return err
+	}
+	if err := s.DB.Model(&caf).Update("last_error", row.LastError).Error; err != nil {
+		return err
+	}
+	status := deliveryFailedStatuses[row.Target]
+	if !CanTransition(caf.Status, status) {
+		return nil
+	}
+
+	if err := s.transition(s.DB, &caf, status); err != nil {
+		return err
+	}
+	err := s.audit(s.DB, caf, "DELIVERY_FAILED", "", map[string]interface{}{
+		"target":         row.Target,
+		"correlation_id": row.CorrelationID,
+		"attempts":       row.Attempts,
+		"error":          row.LastError,
+	})
+	if err != nil || len(cafCompensations[caf.Status]) == 0 {
+		// Nothing to reverse yet: the CAF waits for a retry or cancel
+		return err
+	}
+	return s.compensateIfFinal(caf, row.Target)
+}
+
+// APISender POSTs the payload to the zone's endpoint for the target, signed
+// with the partner's key for the zone.
+type APISender struct {
+	HTTP *http.Client
+	DB   *gorm.DB // for PartnerKeys
+}
+
+func (a APISender) Send(ctx context.Context, row IntegrationOutbox, config ZoneTargetConfig) (OutboxResult, error) {
+	if config.Endpoint == "" {
+		return OutboxResult{}, fmt.Errorf("no API endpoint configured for %s in zone %s", row.Target, config.ZoneCode)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.Endpoint, strings.NewReader(row.Payload))
+	if err != nil {
+		return OutboxResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Correlation-ID", row.CorrelationID)
+	if err := signRequest(req, a.DB, row, config.ZoneCode); err != nil {
+		return OutboxResult{}, err
+	}
+
+	resp, err := a.HTTP.Do(req)
+	if err != nil {
+		return OutboxResult{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPartnerResponse))
+	result := OutboxResult{Code: resp.StatusCode, Body: string(body)}
+	if err != nil {
+		return result, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return result, errors.New(config.Endpoint + " returned " + resp.Status)
+	}
+	return result, nil
+}
+
+// ackOutbox marks the outbox row for corrID ACKED, unless it was already
+// closed, for example by a cancel.
+func ackOutbox(tx *gorm.DB, corrID string) error {
+	return tx.Model(&IntegrationOutbox{}).
+		Where("correlation_id = ? AND status IN ?", corrID, outboxOpenStatuses).
+		Update("status", "ACKED").Error
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// inFlightRecheck is how long a row held back by its zone's MaxInFlight
+// waits before it is tried again.
+const inFlightRecheck = 5 * time.Second
+
+// OutboxRateBucket is the token bucket limiting how fast one target is sent
+// to in one zone, shared by every dispatcher instance.
+type OutboxRateBucket struct {
+	ZoneCode  string    `gorm:"primaryKey" json:"zone_code"`
+	Target    string    `gorm:"primaryKey" json:"target"`
+	Tokens    float64   `json:"tokens"`
+	UpdatedAt time.Time `json:"updated_at"` // when Tokens was last refilled, database clock
+}
+
+// DispatchStats counts what a dispatcher instance has done with the rows of
+// one partner integration since it started.
+type DispatchStats struct {
+	Target          string `json:"target"`
+	ZoneCode        string `json:"zone_code"`
+	Mode            string `json:"mode"`
+	Sent            int64  `json:"sent"`
+	Failed          int64  `json:"failed"`
+	RateLimited     int64  `json:"rate_limited"`     // deferred by RateLimitTPS
+	InFlightCapped  int64  `json:"in_flight_capped"` // deferred by MaxInFlight
+	CircuitDeferred int64  `json:"circuit_deferred"` // deferred by an open circuit
+}
+
+// OutboxQueueDepth counts the open outbox rows of one partner integration
+// in one status.
+type OutboxQueueDepth struct {
+	Target   string     `json:"target"`
+	ZoneCode string     `json:"zone_code"`
+	Mode     string     `json:"mode"`
+	Status   string     `json:"status"`
+	Rows     int64      `json:"rows"`
+	Due      int64      `json:"due"` // PENDING rows whose next attempt is due
+	Oldest   *time.Time `json:"oldest,omitempty"`
+}
+
+// dispatchCounters holds a dispatcher's DispatchStats.
+type dispatchCounters struct {
+	mu    sync.Mutex
+	stats map[CircuitKey]*DispatchStats
+}
+
+func (c *dispatchCounters) add(key CircuitKey, count func(*DispatchStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stats == nil {
+		c.stats = map[CircuitKey]*DispatchStats{}
+	}
+	stats := c.stats[key]
+	if stats == nil {
+		stats = &DispatchStats{Target: key.Target, ZoneCode: key.ZoneCode, Mode: key.Mode}
+		c.stats[key] = stats
+	}
+	count(stats)
+}
+
+// Stats returns the dispatcher's counters, ordered by target, zone and mode.
+func (d *OutboxDispatcher) Stats() []DispatchStats {
+	d.counters.mu.Lock()
+	defer d.counters.mu.Unlock()
+
+	stats := make([]DispatchStats, 0, len(d.counters.stats))
+	for _, s := range d.counters.stats {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Target != stats[j].Target {
+			return stats[i].Target < stats[j].Target
+		}
+		if stats[i].ZoneCode != stats[j].ZoneCode {
+			return stats[i].ZoneCode < stats[j].ZoneCode
+		}
+		return stats[i].Mode < stats[j].Mode
+	})
+	return stats
+}
+
+// dispatchLimits tracks, over one Dispatch call, how much of each
+// partner's capacity the batch has used.
+type dispatchLimits struct {
+	throttled map[CircuitKey]int // rows already deferred by the rate limit
+}
+
+// throttle reports whether row may be sent now under its zone's
+// MaxInFlight and RateLimitTPS for the target. If not, retryAt is when it
+// should be tried again, and the reason is counted. A row that may be sent
+// takes an in-flight slot and a token from the rate bucket.
+func (d *OutboxDispatcher) throttle(limits *dispatchLimits, row IntegrationOutbox, key CircuitKey, config ZoneTargetConfig) (ok bool, retryAt time.Time, err error) {
+	if config.MaxInFlight > 0 {
+		admitted, err := d.admit(row, key, config)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		if !admitted {
+			d.counters.add(key, func(s *DispatchStats) { s.InFlightCapped++ })
+			return false, time.Now().Add(inFlightRecheck), nil
+		}
+	}
+
+	if config.RateLimitTPS > 0 {
+		wait, err := d.takeToken(key, config)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		if wait > 0 {
+			// Rows behind this one in the batch wait a token longer each,
+			// so the backlog is spread out rather than retried at once
+			ahead := limits.throttled[key]
+			limits.throttled[key]++
+			wait += time.Duration(float64(ahead) / config.RateLimitTPS * float64(time.Second))
+			d.counters.add(key, func(s *DispatchStats) { s.RateLimited++ })
+			return false, time.Now().Add(wait), nil
+		}
+	}
+	return true, time.Time{}, nil
+}
+
+// admit takes one of the target's MaxInFlight slots in the zone for row.
+// SENT rows awaiting their ACK hold a slot each, and so do rows a
+// dispatcher has been admitted to send until it records the attempt or its
+// lease runs out. The slots are counted and taken under the lock on the
+// target's OutboxRateBucket, so dispatchers on several instances cannot
+// between them go over the cap.
+func (d *OutboxDispatcher) admit(row IntegrationOutbox, key CircuitKey, config ZoneTargetConfig) (bool, error) {
+	admitted := false
+	err := d.Service.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockRateBucket(tx, key, config); err != nil {
+			return err
+		}
+
+		var n int64
+		if err := tx.Model(&IntegrationOutbox{}).
+			Where("target = ? AND mode = ?", key.Target, key.Mode).
+			Where("(status = ? OR (sending_since IS NOT NULL AND lease_expires_at > now()))", "SENT").
+			Where("caf_id IN (?)", tx.Model(&Caf{}).Select("id").Where("zone_code = ?", key.ZoneCode)).
+			Count(&n).Error; err != nil {
+			return err
+		}
+		if n >= int64(config.MaxInFlight) {
+			return nil
+		}
+
+		res := tx.Model(&IntegrationOutbox{}).Where("id = ? AND lease_owner = ?", row.ID, d.ID).
+			Update("sending_since", gorm.Expr("now()"))
+		admitted = res.RowsAffected > 0
+		return res.Error
+	})
+	return admitted, err
+}
+
+// rateBucket is an OutboxRateBucket locked by lockRateBucket, with the
+// database clock at the time.
+type rateBucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+	Now       time.Time
+}
+
+// lockRateBucket locks the target's bucket in the zone for the rest of tx,
+// creating it full if need be.
+func lockRateBucket(tx *gorm.DB, key CircuitKey, config ZoneTargetConfig) (rateBucket, error) {
+	var bucket rateBucket
+	if err := tx.Exec("INSERT INTO outbox_rate_buckets (zone_code, target, tokens, updated_at) VALUES (?, ?, ?, now()) "+
+		"ON CONFLICT DO NOTHING", key.ZoneCode, key.Target, rateBurst(config)).Error; err != nil {
+		return bucket, err
+	}
+	err := tx.Raw("SELECT tokens, updated_at, now() AS now FROM outbox_rate_buckets "+
+		"WHERE zone_code = ? AND target = ? FOR UPDATE", key.ZoneCode, key.Target).
+		Scan(&bucket).Error
+	return bucket, err
+}
+
+// rateBurst is how many tokens the target's bucket holds at most.
+func rateBurst(config ZoneTargetConfig) float64 {
+	if config.RateBurst < 1 {
+		return math.Max(1, math.Ceil(config.RateLimitTPS))
+	}
+	return float64(config.RateBurst)
+}
+
+// takeToken takes a token from the target's bucket in the zone, refilled at
+// RateLimitTPS up to RateBurst. If the bucket is empty it returns how long
+// until it holds a token again.
+func (d *OutboxDispatcher) takeToken(key CircuitKey, config ZoneTargetConfig) (time.Duration, error) {
+	var wait time.Duration
+	err := d.Service.DB.Transaction(func(tx *gorm.DB) error {
+		bucket, err := lockRateBucket(tx, key, config)
+		if err != nil {
+			return err
+		}
+
+		var tokens float64
+		tokens, wait = drawToken(bucket, config)
+		return tx.Model(&OutboxRateBucket{}).
+			Where("zone_code = ? AND target = ?", key.ZoneCode, key.Target).
+			Updates(map[string]interface{}{"tokens": tokens, "updated_at": bucket.Now}).Error
+	})
+	return wait, err
+}
+
+// drawToken refills bucket for the time since it was last updated and takes
+// a token from it. It returns the tokens left and, if there was no token to
+// take, how long until there is one.
+func drawToken(bucket rateBucket, config ZoneTargetConfig) (float64, time.Duration) {
+	tokens := math.Min(rateBurst(config), bucket.Tokens+bucket.Now.Sub(bucket.UpdatedAt).Seconds()*config.RateLimitTPS)
+	if tokens >= 1 {
+		return tokens - 1, 0
+	}
+	return tokens, time.Duration((1 - tokens) / config.RateLimitTPS * float64(time.Second))
+}
+
+// OutboxQueueDepth counts PENDING and SENT outbox rows by target, zone, mode
+// and status.
+func (s *OnboardingService) OutboxQueueDepth() ([]OutboxQueueDepth, error) {
+	var depth []OutboxQueueDepth
+	err := s.DB.Table("integration_outboxes AS o").
+		Select("o.target, c.zone_code, o.mode, o.status, count(*) AS rows, "+
+			"count(*) FILTER (WHERE o.status = ? AND (o.next_attempt_at IS NULL OR o.next_attempt_at <= now())) AS due, "+
+			"min(o.created_at) AS oldest", "PENDING").
+		Joins("JOIN cafs c ON c.id = o.caf_id").
+		Where("o.status IN ?", outboxOpenStatuses).
+		Group("o.target, c.zone_code, o.mode, o.status").
+		Order("o.target, c.zone_code, o.mode, o.status").
+		Scan(&depth).Error
+	return depth, err
+}
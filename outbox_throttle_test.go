@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateBurst(t *testing.T) {
+	tests := []struct {
+		tps   float64
+		burst int
+		want  float64
+	}{
+		{tps: 5, burst: 10, want: 10},
+		{tps: 5, burst: 0, want: 5},
+		{tps: 2.5, burst: 0, want: 3},
+		{tps: 0.2, burst: 0, want: 1},
+		{tps: 0.2, burst: 4, want: 4},
+	}
+	for _, tt := range tests {
+		config := ZoneTargetConfig{RateLimitTPS: tt.tps, RateBurst: tt.burst}
+		if got := rateBurst(config); got != tt.want {
+			t.Errorf("rateBurst(%v TPS, burst %d) = %v, want %v", tt.tps, tt.burst, got, tt.want)
+		}
+	}
+}
+
+func TestDrawToken(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	config := ZoneTargetConfig{RateLimitTPS: 2, RateBurst: 4}
+
+	tests := []struct {
+		name       string
+		tokens     float64
+		elapsed    time.Duration
+		wantTokens float64
+		wantWait   time.Duration
+	}{
+		{"full bucket", 4, 0, 3, 0},
+		{"refill is capped at the burst", 4, time.Minute, 3, 0},
+		{"refilled from empty", 0, time.Second, 1, 0},
+		{"refilled to exactly one token", 0, 500 * time.Millisecond, 0, 0},
+		{"empty bucket waits for a token", 0, 0, 0, 500 * time.Millisecond},
+		{"part of a token waits for the rest", 0.5, 0, 0.5, 250 * time.Millisecond},
+		{"refill counts toward the wait", 0, 250 * time.Millisecond, 0.5, 250 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := rateBucket{Tokens: tt.tokens, UpdatedAt: start, Now: start.Add(tt.elapsed)}
+			tokens, wait := drawToken(bucket, config)
+			if tokens != tt.wantTokens || wait != tt.wantWait {
+				t.Errorf("drawToken = %v tokens, wait %s; want %v tokens, wait %s", tokens, wait, tt.wantTokens, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestTakeToken(t *testing.T) {
+	db := openTestDB(t)
+	d := &OutboxDispatcher{Service: &OnboardingService{DB: db}, ID: "dispatcher-1"}
+	key := CircuitKey{Target: "PREACT", ZoneCode: "NORTH", Mode: "API"}
+	config := ZoneTargetConfig{RateLimitTPS: 1, RateBurst: 2}
+
+	// now() does not move within the test's transaction, so the bucket is
+	// never refilled
+	for i, want := range []time.Duration{0, 0, time.Second, time.Second} {
+		wait, err := d.takeToken(key, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != want {
+			t.Errorf("take %d: wait %s, want %s", i, wait, want)
+		}
+	}
+}
+
+func TestAdmitMaxInFlight(t *testing.T) {
+	db := openTestDB(t)
+	d := &OutboxDispatcher{Service: &OnboardingService{DB: db}, ID: "dispatcher-1"}
+	key := CircuitKey{Target: "PREACT", ZoneCode: "NORTH", Mode: "API"}
+	config := ZoneTargetConfig{MaxInFlight: 3}
+
+	north := Caf{CafRefNo: "CAF-CAP-1", ZoneCode: "NORTH"}
+	south := Caf{CafRefNo: "CAF-CAP-2", ZoneCode: "SOUTH"}
+	if err := db.Create(&[]*Caf{&north, &south}).Error; err != nil {
+		t.Fatal(err)
+	}
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	row := func(corrID string, caf Caf, target, status, owner string, lease, sending *time.Time) IntegrationOutbox {
+		return IntegrationOutbox{CafID: caf.ID, Target: target, Mode: "API", CorrelationID: corrID, Status: status,
+			LeaseOwner: owner, LeaseExpiresAt: lease, SendingSince: sending}
+	}
+	rows := []IntegrationOutbox{
+		// Holding a slot
+		row("awaiting-ack", north, "PREACT", "SENT", "", nil, nil),
+		row("sending-elsewhere", north, "PREACT", "PENDING", "dispatcher-2", &future, &past),
+		// Not holding one
+		row("lease-lapsed", north, "PREACT", "PENDING", "dispatcher-2", &past, &past),
+		row("claimed-not-admitted", north, "PREACT", "PENDING", "dispatcher-2", &future, nil),
+		row("other-zone", south, "PREACT", "SENT", "", nil, nil),
+		row("other-target", north, "TV", "SENT", "", nil, nil),
+		row("acked", north, "PREACT", "ACKED", "", nil, nil),
+		// To admit
+		row("first", north, "PREACT", "PENDING", "dispatcher-1", &future, nil),
+		row("second", north, "PREACT", "PENDING", "dispatcher-1", &future, nil),
+		row("not-ours", north, "PREACT", "PENDING", "dispatcher-2", &future, nil),
+	}
+	for i := range rows {
+		if err := db.Create(&rows[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	byCorrID := map[string]IntegrationOutbox{}
+	for _, r := range rows {
+		byCorrID[r.CorrelationID] = r
+	}
+
+	tests := []struct {
+		corrID string
+		want   bool
+	}{
+		{"not-ours", false}, // leased by another dispatcher
+		{"first", true},     // takes the last of 3 slots
+		{"second", false},   // the cap is reached
+	}
+	for _, tt := range tests {
+		admitted, err := d.admit(byCorrID[tt.corrID], key, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if admitted != tt.want {
+			t.Errorf("admit(%s) = %v, want %v", tt.corrID, admitted, tt.want)
+		}
+	}
+
+	var first IntegrationOutbox
+	if err := db.First(&first, byCorrID["first"].ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if first.SendingSince == nil {
+		t.Error("admitted row has no sending_since")
+	}
+}
@@ -0,0 +1,152 @@
+-- Partner database tables for DBLINK integration mode (PARTNER_DB_DSN).
+-- The onboarding service writes one row per request to <target>_request;
+-- the partner answers with a row in <target>_response, which the service
+-- picks up (on NOTIFY dblink_response, or by polling) and applies as an ACK.
+
+CREATE SCHEMA IF NOT EXISTS dblink;
+
+-- Wakes the onboarding service when a response is written
+CREATE OR REPLACE FUNCTION dblink.notify_response() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('dblink_response', TG_TABLE_NAME);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Pre-activation
+CREATE TABLE dblink.preact_request (
+    correlation_id VARCHAR(100) PRIMARY KEY,
+    zone_code VARCHAR(10) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE dblink.preact_response (
+    id BIGSERIAL PRIMARY KEY,
+    correlation_id VARCHAR(100) NOT NULL REFERENCES dblink.preact_request(correlation_id),
+    ack_status VARCHAR(20) NOT NULL CHECK (ack_status IN ('SUCCESS', 'FAILED')),
+    response_data JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    processed_at TIMESTAMP,
+    error TEXT
+);
+
+CREATE INDEX idx_preact_response_unprocessed ON dblink.preact_response(id) WHERE processed_at IS NULL;
+
+CREATE TRIGGER preact_response_notify AFTER INSERT ON dblink.preact_response
+    FOR EACH ROW EXECUTE FUNCTION dblink.notify_response();
+
+-- Televerification
+CREATE TABLE dblink.tv_request (
+    correlation_id VARCHAR(100) PRIMARY KEY,
+    zone_code VARCHAR(10) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE dblink.tv_response (
+    id BIGSERIAL PRIMARY KEY,
+    correlation_id VARCHAR(100) NOT NULL REFERENCES dblink.tv_request(correlation_id),
+    ack_status VARCHAR(20) NOT NULL CHECK (ack_status IN ('SUCCESS', 'FAILED')),
+    response_data JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    processed_at TIMESTAMP,
+    error TEXT
+);
+
+CREATE INDEX idx_tv_response_unprocessed ON dblink.tv_response(id) WHERE processed_at IS NULL;
+
+CREATE TRIGGER tv_response_notify AFTER INSERT ON dblink.tv_response
+    FOR EACH ROW EXECUTE FUNCTION dblink.notify_response();
+
+-- Final Activation
+CREATE TABLE dblink.finalact_request (
+    correlation_id VARCHAR(100) PRIMARY KEY,
+    zone_code VARCHAR(10) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE dblink.finalact_response (
+    id BIGSERIAL PRIMARY KEY,
+    correlation_id VARCHAR(100) NOT NULL REFERENCES dblink.finalact_request(correlation_id),
+    ack_status VARCHAR(20) NOT NULL CHECK (ack_status IN ('SUCCESS', 'FAILED')),
+    response_data JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    processed_at TIMESTAMP,
+    error TEXT
+);
+
+CREATE INDEX idx_finalact_response_unprocessed ON dblink.finalact_response(id) WHERE processed_at IS NULL;
+
+CREATE TRIGGER finalact_response_notify AFTER INSERT ON dblink.finalact_response
+    FOR EACH ROW EXECUTE FUNCTION dblink.notify_response();
+
+-- Commission
+CREATE TABLE dblink.commission_request (
+    correlation_id VARCHAR(100) PRIMARY KEY,
+    zone_code VARCHAR(10) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE dblink.commission_response (
+    id BIGSERIAL PRIMARY KEY,
+    correlation_id VARCHAR(100) NOT NULL REFERENCES dblink.commission_request(correlation_id),
+    ack_status VARCHAR(20) NOT NULL CHECK (ack_status IN ('SUCCESS', 'FAILED')),
+    response_data JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    processed_at TIMESTAMP,
+    error TEXT
+);
+
+CREATE INDEX idx_commission_response_unprocessed ON dblink.commission_response(id) WHERE processed_at IS NULL;
+
+CREATE TRIGGER commission_response_notify AFTER INSERT ON dblink.commission_response
+    FOR EACH ROW EXECUTE FUNCTION dblink.notify_response();
+
+-- Pre-activation Rollback
+CREATE TABLE dblink.preact_rollback_request (
+    correlation_id VARCHAR(100) PRIMARY KEY,
+    zone_code VARCHAR(10) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE dblink.preact_rollback_response (
+    id BIGSERIAL PRIMARY KEY,
+    correlation_id VARCHAR(100) NOT NULL REFERENCES dblink.preact_rollback_request(correlation_id),
+    ack_status VARCHAR(20) NOT NULL CHECK (ack_status IN ('SUCCESS', 'FAILED')),
+    response_data JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    processed_at TIMESTAMP,
+    error TEXT
+);
+
+CREATE INDEX idx_preact_rollback_response_unprocessed ON dblink.preact_rollback_response(id) WHERE processed_at IS NULL;
+
+CREATE TRIGGER preact_rollback_response_notify AFTER INSERT ON dblink.preact_rollback_response
+    FOR EACH ROW EXECUTE FUNCTION dblink.notify_response();
+
+-- Final Activation Rollback
+CREATE TABLE dblink.finalact_rollback_request (
+    correlation_id VARCHAR(100) PRIMARY KEY,
+    zone_code VARCHAR(10) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE dblink.finalact_rollback_response (
+    id BIGSERIAL PRIMARY KEY,
+    correlation_id VARCHAR(100) NOT NULL REFERENCES dblink.finalact_rollback_request(correlation_id),
+    ack_status VARCHAR(20) NOT NULL CHECK (ack_status IN ('SUCCESS', 'FAILED')),
+    response_data JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    processed_at TIMESTAMP,
+    error TEXT
+);
+
+CREATE INDEX idx_finalact_rollback_response_unprocessed ON dblink.finalact_rollback_response(id) WHERE processed_at IS NULL;
+
+CREATE TRIGGER finalact_rollback_response_notify AFTER INSERT ON dblink.finalact_rollback_response
+    FOR EACH ROW EXECUTE FUNCTION dblink.notify_response();
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ProcessInstance states.
+const (
+	InstanceWaiting    = "WAITING"    // on a user task or callback, until Signal
+	InstanceParked     = "PARKED"     // on a service task, until Resume
+	InstanceEnded      = "ENDED"      // reached an end event
+	InstanceTerminated = "TERMINATED" // stopped by Terminate or Fail
+)
+
+var (
+	// ErrNoProcessInstance is returned when a CAF has no process instance.
+	ErrNoProcessInstance = errors.New("no process instance for CAF")
+	// ErrNotWaiting is returned by Signal when the instance is not waiting
+	// on the named activity.
+	ErrNotWaiting = errors.New("process instance is not waiting on that activity")
+	// ErrNotParked is returned by Resume when the instance is not parked on
+	// a service task.
+	ErrNotParked = errors.New("process instance is not parked on a service task")
+
+	// ErrWaitForSignal is returned by a Delegate to wait on its task until
+	// Signal is called for it.
+	ErrWaitForSignal = errors.New("wait for signal")
+	// ErrWaitForResume is returned by a Delegate to park on its task until
+	// Resume is called.
+	ErrWaitForResume = errors.New("wait for resume")
+)
+
+// TaskError is returned when a service task the engine ran failed. The
+// instance is saved parked on the task, so the Start, Signal or Resume that
+// led to it still took effect.
+type TaskError struct {
+	Activity string
+	Err      error
+}
+
+func (e *TaskError) Error() string { return e.Err.Error() }
+
+func (e *TaskError) Unwrap() error { return e.Err }
+
+// ProcessInstance is the persisted position of one CAF in the process.
+type ProcessInstance struct {
+	CafRefNo   string    `gorm:"primaryKey" json:"caf_ref_no"`
+	ProcessKey string    `json:"process_key"`
+	ActivityID string    `json:"activity_id"`
+	State      string    `json:"state"`
+	Variables  string    `json:"variables"`
+	LastError  string    `json:"last_error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// TaskContext is handed to the Delegate executing a service task.
+type TaskContext struct {
+	CafRefNo  string
+	Node      *FlowNode
+	Variables map[string]interface{}
+	Resumed   bool // true when Resume re-entered a parked task
+}
+
+// Delegate implements a service task's delegateExpression. Its result is
+// stored under the task's resultVariableName field, if any.
+type Delegate func(ctx *TaskContext) (interface{}, error)
+
+// Workflow drives the CAF's process instance. ProcessEngine runs it
+// in-process; FlowableWorkflow runs it on a Flowable server.
+type Workflow interface {
+	Start(cafRefNo string, vars map[string]interface{}) error
+	Signal(cafRefNo, key string, result interface{}, vars map[string]interface{}) error
+	Fail(cafRefNo, key string, result interface{}) error
+	Resume(cafRefNo string) error
+	Terminate(cafRefNo, reason string) error
+}
+
+// ProcessEngine executes a ProcessDefinition in-process, one instance per
+// CAF, without a Flowable server.
+type ProcessEngine struct {
+	db        *gorm.DB
+	def       *ProcessDefinition
+	delegates map[string]Delegate
+}
+
+// NewProcessEngine checks that every service task in def has a delegate.
+func NewProcessEngine(db *gorm.DB, def *ProcessDefinition, delegates map[string]Delegate) (*ProcessEngine, error) {
+	for _, node := range def.Nodes {
+		if node.Kind == NodeServiceTask && delegates[node.Delegate] == nil {
+			return nil, fmt.Errorf("no delegate registered for ${%s} (task %q)", node.Delegate, node.ID)
+		}
+	}
+	return &ProcessEngine{db: db, def: def, delegates: delegates}, nil
+}
+
+// Start creates the CAF's process instance and runs it to its first wait
+// state. Starting a CAF that already has an instance does nothing.
+func (e *ProcessEngine) Start(cafRefNo string, vars map[string]interface{}) error {
+	return e.StartAt(cafRefNo, e.def.StartID, vars)
+}
+
+// StartAt is Start for a CAF already part way through the process: the
+// instance is created on activity key, either its id or its operation
+// field, and run from there.
+func (e *ProcessEngine) StartAt(cafRefNo, key string, vars map[string]interface{}) error {
+	node := e.def.activity(key)
+	if node == nil {
+		return fmt.Errorf("no activity %q in process %s", key, e.def.Key)
+	}
+
+	var existing int64
+	if err := e.db.Model(&ProcessInstance{}).Where("caf_ref_no = ?", cafRefNo).Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return nil
+	}
+
+	varsJSON, _ := json.Marshal(vars)
+	inst := ProcessInstance{
+		CafRefNo:   cafRefNo,
+		ProcessKey: e.def.Key,
+		ActivityID: node.ID,
+		State:      InstanceWaiting,
+		Variables:  string(varsJSON),
+	}
+	if err := e.db.Create(&inst).Error; err != nil {
+		return err
+	}
+
+	return e.withInstance(cafRefNo, func(inst *ProcessInstance, vars map[string]interface{}) error {
+		return e.run(inst, vars, node.ID, false)
+	})
+}
+
+// Signal completes the activity the instance is waiting on and continues.
+// key is either the activity id or its operation field. result, if not nil,
+// is stored under the activity's resultVariableName; vars are merged into
+// the process variables.
+func (e *ProcessEngine) Signal(cafRefNo, key string, result interface{}, vars map[string]interface{}) error {
+	return e.withInstance(cafRefNo, func(inst *ProcessInstance, processVars map[string]interface{}) error {
+		node, err := e.waitingOn(inst, key)
+		if err != nil {
+			return err
+		}
+		e.merge(node, processVars, result, vars)
+
+		next, ok := e.def.next(node, processVars, false)
+		if !ok {
+			return fmt.Errorf("no sequence flow out of %q matches", node.ID)
+		}
+		return e.run(inst, processVars, next, false)
+	})
+}
+
+// Fail completes the activity the instance is waiting on with a failure
+// result. If a conditional flow out of the activity matches, the process
+// follows it; otherwise the instance is terminated.
+func (e *ProcessEngine) Fail(cafRefNo, key string, result interface{}) error {
+	return e.withInstance(cafRefNo, func(inst *ProcessInstance, processVars map[string]interface{}) error {
+		node, err := e.waitingOn(inst, key)
+		if err != nil {
+			return err
+		}
+		e.merge(node, processVars, result, nil)
+
+		next, ok := e.def.next(node, processVars, true)
+		if !ok {
+			inst.State = InstanceTerminated
+			return nil
+		}
+		return e.run(inst, processVars, next, false)
+	})
+}
+
+// Resume re-enters the service task the instance is parked on.
+func (e *ProcessEngine) Resume(cafRefNo string) error {
+	return e.withInstance(cafRefNo, func(inst *ProcessInstance, vars map[string]interface{}) error {
+		if inst.State != InstanceParked {
+			return ErrNotParked
+		}
+		return e.run(inst, vars, inst.ActivityID, true)
+	})
+}
+
+// Terminate stops the instance wherever it is. Ended instances are left
+// as they are.
+func (e *ProcessEngine) Terminate(cafRefNo, reason string) error {
+	return e.withInstance(cafRefNo, func(inst *ProcessInstance, vars map[string]interface{}) error {
+		if inst.State == InstanceEnded || inst.State == InstanceTerminated {
+			return nil
+		}
+		inst.State = InstanceTerminated
+		inst.LastError = reason
+		return nil
+	})
+}
+
+// withInstance loads and locks the CAF's instance, calls fn and saves the
+// instance even when fn fails, so a failing delegate leaves it parked on
+// the task that failed.
+func (e *ProcessEngine) withInstance(cafRefNo string, fn func(*ProcessInstance, map[string]interface{}) error) error {
+	var runErr error
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		var inst ProcessInstance
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("caf_ref_no = ?", cafRefNo).First(&inst).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNoProcessInstance
+		}
+		if err != nil {
+			return err
+		}
+
+		vars := map[string]interface{}{}
+		json.Unmarshal([]byte(inst.Variables), &vars)
+
+		runErr = fn(&inst, vars)
+
+		varsJSON, _ := json.Marshal(vars)
+		inst.Variables = string(varsJSON)
+		return tx.Save(&inst).Error
+	})
+	if err != nil {
+		return err
+	}
+	return runErr
+}
+
+func (e *ProcessEngine) waitingOn(inst *ProcessInstance, key string) (*FlowNode, error) {
+	node := e.def.Nodes[inst.ActivityID]
+	if inst.State != InstanceWaiting || node == nil || (node.ID != key && node.Fields["operation"] != key) {
+		return nil, fmt.Errorf("%w: %s is at %s (%s)", ErrNotWaiting, inst.CafRefNo, inst.ActivityID, inst.State)
+	}
+	return node, nil
+}
+
+func (e *ProcessEngine) merge(node *FlowNode, processVars map[string]interface{}, result interface{}, vars map[string]interface{}) {
+	for k, v := range vars {
+		processVars[k] = v
+	}
+	if name := node.Fields["resultVariableName"]; name != "" && result != nil {
+		processVars[name] = result
+	}
+}
+
+// run executes from nodeID until the instance reaches a wait state or an
+// end event.
+func (e *ProcessEngine) run(inst *ProcessInstance, vars map[string]interface{}, nodeID string, resumed bool) error {
+	for {
+		node := e.def.Nodes[nodeID]
+		inst.ActivityID = node.ID
+		inst.LastError = ""
+
+		switch node.Kind {
+		case NodeUserTask:
+			inst.State = InstanceWaiting
+			return nil
+		case NodeEndEvent:
+			inst.State = InstanceEnded
+			return nil
+		case NodeServiceTask:
+			result, err := e.delegates[node.Delegate](&TaskContext{
+				CafRefNo:  inst.CafRefNo,
+				Node:      node,
+				Variables: vars,
+				Resumed:   resumed,
+			})
+			resumed = false
+			switch {
+			case errors.Is(err, ErrWaitForSignal):
+				inst.State = InstanceWaiting
+				return nil
+			case errors.Is(err, ErrWaitForResume):
+				inst.State = InstanceParked
+				return nil
+			case err != nil:
+				inst.State = InstanceParked
+				inst.LastError = err.Error()
+				return &TaskError{Activity: node.ID, Err: err}
+			}
+			if name := node.Fields["resultVariableName"]; name != "" {
+				vars[name] = result
+			}
+		}
+
+		next, ok := e.def.next(node, vars, false)
+		if !ok {
+			inst.State = InstanceParked
+			inst.LastError = fmt.Sprintf("no sequence flow out of %q matches", node.ID)
+			return &TaskError{Activity: node.ID, Err: errors.New(inst.LastError)}
+		}
+		nodeID = next
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// QuarantinedMessage statuses.
+const (
+	QuarantineHeld     = "QUARANTINED"
+	QuarantineReplayed = "REPLAYED"
+)
+
+// ErrAlreadyReplayed is returned when replaying or fixing a quarantined
+// message that has already made it through Step 1.
+var ErrAlreadyReplayed = errors.New("quarantined message has already been replayed")
+
+// QuarantinedMessage is a CAF message the consumer could not process,
+// kept with the error until an operator fixes and replays it.
+type QuarantinedMessage struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	Topic      string     `gorm:"column:kafka_topic;uniqueIndex:idx_quarantine_source" json:"topic"`
+	Partition  int        `gorm:"column:kafka_partition;uniqueIndex:idx_quarantine_source" json:"partition"`
+	Offset     int64      `gorm:"column:kafka_offset;uniqueIndex:idx_quarantine_source" json:"offset"`
+	Key        string     `json:"key"`
+	Payload    string     `json:"payload"`
+	Error      string     `json:"error"`
+	Attempts   int        `json:"attempts"`
+	Status     string     `gorm:"index" json:"status"`
+	FixedBy    string     `json:"fixed_by,omitempty"`
+	ReplayedAt *time.Time `json:"replayed_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// TableName overrides GORM's quarantined_messages.
+func (QuarantinedMessage) TableName() string {
+	return "caf_quarantine"
+}
+
+// Quarantine publishes a message that failed Step 1 to the dead-letter
+// topic and records it in caf_quarantine. A message quarantined again, for
+// example after a redelivery, has its attempt count bumped. Only a failure
+// to record it is returned; the dead-letter publish is best effort.
+func (s *OnboardingService) Quarantine(ctx context.Context, msg kafka.Message, cause error) error {
+	if s.DeadLetter != nil {
+		err := s.DeadLetter.WriteMessages(ctx, kafka.Message{
+			Key:   msg.Key,
+			Value: msg.Value,
+			Headers: append(msg.Headers,
+				kafka.Header{Key: "x-error", Value: []byte(cause.Error())},
+				kafka.Header{Key: "x-source-topic", Value: []byte(msg.Topic)},
+				kafka.Header{Key: "x-source-partition", Value: []byte(strconv.Itoa(msg.Partition))},
+				kafka.Header{Key: "x-source-offset", Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+			),
+		})
+		if err != nil {
+			log.Printf("Dead-letter publish failed (partition %d, offset %d): %v", msg.Partition, msg.Offset, err)
+		}
+	}
+
+	row := QuarantinedMessage{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       string(msg.Key),
+		Payload:   string(msg.Value),
+		Error:     cause.Error(),
+		Attempts:  1,
+		Status:    QuarantineHeld,
+	}
+	return s.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "kafka_topic"}, {Name: "kafka_partition"}, {Name: "kafka_offset"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"error":      row.Error,
+			"attempts":   gorm.Expr("caf_quarantine.attempts + 1"),
+			"updated_at": time.Now(),
+		}),
+	}).Create(&row).Error
+}
+
+// ListQuarantine returns quarantined messages, newest first, optionally
+// filtered by status.
+func (s *OnboardingService) ListQuarantine(status string, limit int) ([]QuarantinedMessage, error) {
+	var rows []QuarantinedMessage
+	q := s.DB.Order("id DESC").Limit(limit)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	return rows, q.Find(&rows).Error
+}
+
+// FixQuarantined replaces the payload of a quarantined message. The new
+// payload must at least be a JSON object; it is fully validated on replay.
+func (s *OnboardingService) FixQuarantined(id uint, payload json.RawMessage, operator string) (QuarantinedMessage, error) {
+	var row QuarantinedMessage
+	if err := s.DB.First(&row, id).Error; err != nil {
+		return row, err
+	}
+	if row.Status == QuarantineReplayed {
+		return row, ErrAlreadyReplayed
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(payload, &obj); err != nil {
+		return row, &ValidationError{Fields: []FieldError{{Message: "payload must be a JSON object: " + err.Error()}}}
+	}
+
+	row.Payload = string(payload)
+	row.FixedBy = operator
+	return row, s.DB.Model(&row).Updates(map[string]interface{}{"payload": row.Payload, "fixed_by": operator}).Error
+}
+
+// ReplayQuarantined runs a quarantined message through Step 1 again. On
+// failure the message stays quarantined with the new error and one more
+// attempt.
+func (s *OnboardingService) ReplayQuarantined(id uint) (QuarantinedMessage, error) {
+	var row QuarantinedMessage
+	if err := s.DB.First(&row, id).Error; err != nil {
+		return row, err
+	}
+	if row.Status == QuarantineReplayed {
+		return row, ErrAlreadyReplayed
+	}
+
+	msg, err := ParseCAFMessage([]byte(row.Payload))
+	if err == nil {
+		err = s.Step1ProcessKafkaCAF(msg, KafkaSource{Topic: row.Topic, Partition: row.Partition, Offset: row.Offset})
+	}
+	if err != nil {
+		row.Error = err.Error()
+		row.Attempts++
+		if updErr := s.DB.Model(&row).Updates(map[string]interface{}{"error": row.Error, "attempts": row.Attempts}).Error; updErr != nil {
+			return row, updErr
+		}
+		return row, err
+	}
+
+	now := time.Now()
+	row.Status = QuarantineReplayed
+	row.ReplayedAt = &now
+	return row, s.DB.Model(&row).Updates(map[string]interface{}{"status": row.Status, "replayed_at": now}).Error
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrRetryLimitReached is returned by RetryStep once a step has been
+// re-sent as many times as the zone's MaxRetries for its target allows.
+var ErrRetryLimitReached = errors.New("retry limit reached for step")
+
+// ErrNotRetryable is returned by RetryStep for a CAF that is not in a
+// failed or timed-out status.
+var ErrNotRetryable = errors.New("CAF is not in a retryable status")
+
+// defaultMaxRetries applies to zones with no ZoneTargetConfig row for a
+// target.
+const defaultMaxRetries = 3
+
+// cafRetryTargets maps each failed or timed-out status to the outbox target
+// of the step that failed.
+var cafRetryTargets = map[string]string{
+	StatusPreactFailed:      "PREACT",
+	StatusPreactTimeout:     "PREACT",
+	StatusTvFailed:          "TV",
+	StatusTvTimeout:         "TV",
+	StatusFinalactFailed:    "FINALACT",
+	StatusFinalactTimeout:   "FINALACT",
+	StatusCommissionFailed:  "COMMISSION",
+	StatusCommissionTimeout: "COMMISSION",
+}
+
+// cafSendSteps maps each outbox target to the step that emits it.
+var cafSendSteps = map[string]func(*OnboardingService, string) error{
+	"PREACT":     (*OnboardingService).Step3PreActivation,
+	"TV":         (*OnboardingService).Step5TeleVerification,
+	"FINALACT":   (*OnboardingService).Step7FinalActivation,
+	"COMMISSION": (*OnboardingService).Step9SancharsoftCommission,
+}
+
+// retriesLeft returns how many more times target may be re-sent for caf.
+func (s *OnboardingService) retriesLeft(caf Caf, target string) (int, error) {
+	var sent int64
+	if err := s.DB.Model(&IntegrationOutbox{}).
+		Where("caf_id = ? AND target = ?", caf.ID, target).
+		Count(&sent).Error; err != nil {
+		return 0, err
+	}
+	return s.targetConfig(caf.ZoneCode, target).MaxRetries - (int(sent) - 1), nil
+}
+
+// RetryStep re-runs the step a failed CAF stopped at, emitting a fresh
+// IntegrationOutbox row with a new correlation ID. A CAF whose rollback was
+// refused gets its refused reversals re-sent instead.
+func (s *OnboardingService) RetryStep(cafRefNo, operator string) error {
+	caf, err := s.findCaf(cafRefNo)
+	if err != nil {
+		return err
+	}
+
+	if caf.Status == StatusRollbackFailed {
+		return s.retryCompensation(caf, operator)
+	}
+
+	target, ok := cafRetryTargets[caf.Status]
+	if !ok {
+		return ErrNotRetryable
+	}
+
+	limit := s.targetConfig(caf.ZoneCode, target).MaxRetries
+	left, err := s.retriesLeft(caf, target)
+	if err != nil {
+		return err
+	}
+	if left <= 0 {
+		return fmt.Errorf("%w: %s retried %d times", ErrRetryLimitReached, target, limit)
+	}
+	retries := limit - left
+
+	failedStatus := caf.Status
+	return s.inTx(func(s *OnboardingService) error {
+		if err := cafSendSteps[target](s, cafRefNo); err != nil {
+			return err
+		}
+
+		caf, err := s.findCaf(cafRefNo)
+		if err != nil {
+			return err
+		}
+		return s.audit(s.DB, caf, "RETRY", operator, map[string]interface{}{
+			"target":        target,
+			"failed_status": failedStatus,
+			"retry":         retries + 1,
+		})
+	})
+}
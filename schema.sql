@@ -25,7 +25,7 @@ CREATE TABLE onboarding.caf (
     zone_code VARCHAR(10),
     customer_name VARCHAR(100),
     customer_phone VARCHAR(15),
-    status VARCHAR(20) DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'VALIDATED', 'APPROVED', 'REJECTED', 'PRE_ACTIVATED', 'TELE_VERIFIED', 'ACTIVATED', 'FAILED')),
+    status VARCHAR(20) DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'VALIDATED', 'APPROVED', 'REJECTED', 'PRE_ACTIVATED', 'TELE_VERIFIED', 'ACTIVATED', 'COMPLETED', 'FAILED')),
     request_data JSONB,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
@@ -67,6 +67,39 @@ CREATE TABLE onboarding.commission_status (
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Idempotency-Key Table: first request per key and its response
+CREATE TABLE onboarding.idempotency_keys (
+    key VARCHAR(255) NOT NULL,
+    method VARCHAR(10) NOT NULL,
+    path TEXT NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    content_type VARCHAR(100) NOT NULL DEFAULT '',
+    body BYTEA,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (key, method, path)
+);
+
+-- CAF Quarantine Table: Kafka records that failed validation, kept until
+-- an operator fixes and replays them
+CREATE TABLE onboarding.caf_quarantine (
+    id SERIAL PRIMARY KEY,
+    kafka_topic VARCHAR(255) NOT NULL,
+    kafka_partition INTEGER NOT NULL,
+    kafka_offset BIGINT NOT NULL,
+    key TEXT,
+    payload TEXT,
+    error TEXT,
+    attempts INTEGER NOT NULL DEFAULT 1,
+    status VARCHAR(20) NOT NULL DEFAULT 'QUARANTINED',
+    fixed_by VARCHAR(50),
+    replayed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (kafka_topic, kafka_partition, kafka_offset)
+);
+
 -- Insert Sample Data
 INSERT INTO onboarding.zone_config (zone_code, pre_activation_mode, televerification_mode, final_activation_mode, commission_mode, callback_url) VALUES
 ('NORTH', 'API', 'DB_LINK', 'API', 'API', 'http://localhost:8080/callback/preact'),
@@ -78,3 +111,4 @@ INSERT INTO onboarding.zone_config (zone_code, pre_activation_mode, televerifica
 CREATE INDEX idx_caf_status ON onboarding.caf(status);
 CREATE INDEX idx_caf_zone ON onboarding.caf(zone_code);
 CREATE INDEX idx_caf_plan ON onboarding.caf(plan_code);
+CREATE INDEX idx_idempotency_created ON onboarding.idempotency_keys(created_at);
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Headers carrying the HMAC signature of partner requests, both the ones
+// the dispatcher sends and the callbacks partners send back.
+const (
+	SignatureHeader          = "X-Signature"           // hex HMAC-SHA256, see signPayload
+	SignatureKeyHeader       = "X-Signature-Key-Id"    // PartnerKey.KeyID of the secret used
+	SignatureTimestampHeader = "X-Signature-Timestamp" // Unix seconds
+)
+
+// defaultReplayWindow is how far a callback's signature timestamp may be
+// from now.
+const defaultReplayWindow = 5 * time.Minute
+
+// maxCallbackBody is the largest callback body CallbackSignature reads.
+const maxCallbackBody = 1 << 20
+
+var (
+	// ErrNoSigningKey is returned when a partner has no active key in a zone.
+	ErrNoSigningKey = errors.New("no active signing key")
+	// ErrBadSignature is returned for a callback that is unsigned, signed
+	// with an unknown or expired key, signed wrongly, or signed outside the
+	// replay window.
+	ErrBadSignature = errors.New("invalid callback signature")
+	// ErrPartnerKeyExists is returned by AddPartnerKey for a key ID already
+	// used for the partner in the zone.
+	ErrPartnerKeyExists = errors.New("partner key ID already exists")
+)
+
+// PartnerKey is a secret shared with a partner in one zone. Partners are
+// named by outbox target; reversals use the key of the step they undo.
+//
+// A key is accepted on callbacks from when it is added until ExpiresAt, and
+// signs outbound requests from ActiveFrom, the newest such key winning. To
+// rotate, add the new key with an ActiveFrom far enough ahead for the
+// partner to install it, then expire the old one once the partner has
+// switched.
+//
+// A zone can opt out of signing while its partners are enrolled with
+// ZoneConfig.AllowUnsigned.
+type PartnerKey struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	ZoneCode   string     `gorm:"uniqueIndex:idx_partner_key" json:"zone_code"`
+	Partner    string     `gorm:"uniqueIndex:idx_partner_key" json:"partner"`
+	KeyID      string     `gorm:"uniqueIndex:idx_partner_key" json:"key_id"`
+	Secret     string     `json:"-"`
+	ActiveFrom time.Time  `json:"active_from"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// partnerOf returns the partner a target's requests go to.
+func partnerOf(target string) string {
+	for forward, rollback := range rollbackTargets {
+		if rollback == target {
+			return forward
+		}
+	}
+	return target
+}
+
+// signPayload signs a request body for a correlation ID at a Unix time:
+// hex HMAC-SHA256 of "<timestamp>\n<correlation ID>\n<body>".
+func signPayload(secret string, timestamp int64, corrID string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "\n" + corrID + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signingKey returns the key partner's requests in zone are signed with at
+// now.
+func signingKey(db *gorm.DB, zoneCode, partner string, now time.Time) (PartnerKey, error) {
+	var key PartnerKey
+	err := db.Where("zone_code = ? AND partner = ? AND active_from <= ?", zoneCode, partner, now).
+		Where("expires_at IS NULL OR expires_at > ?", now).
+		Order("active_from DESC, id DESC").First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return key, fmt.Errorf("%w for %s in zone %s", ErrNoSigningKey, partner, zoneCode)
+	}
+	return key, err
+}
+
+// signingOptional reports whether zone has opted out of signing with
+// ZoneConfig.AllowUnsigned.
+func signingOptional(db *gorm.DB, zoneCode string) (bool, error) {
+	var config ZoneConfig
+	err := db.Select("zone_code", "allow_unsigned").Where("zone_code = ?", zoneCode).First(&config).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return config.AllowUnsigned, err
+}
+
+// signRequest sets the signature headers of an outbound request for row. A
+// request to a partner with no active key is left unsigned only in a zone
+// that allows it.
+func signRequest(req *http.Request, db *gorm.DB, row IntegrationOutbox, zoneCode string) error {
+	now := time.Now()
+	key, err := signingKey(db, zoneCode, partnerOf(row.Target), now)
+	if errors.Is(err, ErrNoSigningKey) {
+		optional, optErr := signingOptional(db, zoneCode)
+		if optErr != nil {
+			return optErr
+		}
+		if optional {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	req.Header.Set(SignatureKeyHeader, key.KeyID)
+	req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(SignatureHeader, signPayload(key.Secret, now.Unix(), row.CorrelationID, []byte(row.Payload)))
+	return nil
+}
+
+// CallbackSignature rejects, with 401, partner callbacks that are not
+// signed by the partner of the :corr_id outbox row in its CAF's zone with a
+// timestamp within window of now. Callbacks for an unknown correlation ID
+// are kept as OrphanCallbacks and rejected with 404, and bodies over
+// maxCallbackBody with 413.
+func CallbackSignature(s *OnboardingService, window time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxCallbackBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.AbortWithStatusJSON(413, gin.H{"error": fmt.Sprintf("callback body over %d bytes", tooLarge.Limit)})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		corrID := c.Param("corr_id")
+		err = s.verifyCallback(corrID, c.Request.Header, body, time.Now(), window)
+		switch {
+		case errors.Is(err, ErrUnknownCorrelation):
+			s.recordOrphan(OrphanCallback{
+				CorrelationID: corrID,
+				Reason:        OrphanUnknown,
+				Source:        c.Request.Method + " " + c.FullPath(),
+				Payload:       string(body),
+				RemoteAddr:    c.ClientIP(),
+			})
+			c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrBadSignature):
+			log.Printf("Rejected callback %s: %v", c.Request.URL.Path, err)
+			c.AbortWithStatusJSON(401, gin.H{"error": ErrBadSignature.Error()})
+		case err != nil:
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+		default:
+			c.Next()
+		}
+	}
+}
+
+// verifyCallback checks the signature headers of a callback for corrID.
+// Unsigned callbacks are accepted only in a zone that allows them.
+func (s *OnboardingService) verifyCallback(corrID string, h http.Header, body []byte, now time.Time, window time.Duration) error {
+	var row IntegrationOutbox
+	if err := s.DB.Select("caf_id", "target").Where("correlation_id = ?", corrID).First(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w: %s", ErrUnknownCorrelation, corrID)
+		}
+		return err
+	}
+
+	var caf Caf
+	if err := s.DB.Select("id", "zone_code").First(&caf, row.CafID).Error; err != nil {
+		return err
+	}
+
+	if h.Get(SignatureKeyHeader) == "" || h.Get(SignatureHeader) == "" {
+		optional, err := signingOptional(s.DB, caf.ZoneCode)
+		if err != nil || optional {
+			return err
+		}
+	}
+	return checkSignature(corrID, h, body, now, window, func(keyID string) (PartnerKey, error) {
+		var key PartnerKey
+		err := s.DB.Where("zone_code = ? AND partner = ? AND key_id = ?", caf.ZoneCode, partnerOf(row.Target), keyID).
+			Where("expires_at IS NULL OR expires_at > ?", now).First(&key).Error
+		return key, err
+	})
+}
+
+// checkSignature checks the signature headers of a callback for corrID
+// against the partner key keyFor finds by ID, which returns
+// gorm.ErrRecordNotFound for an unknown or expired key.
+func checkSignature(corrID string, h http.Header, body []byte, now time.Time, window time.Duration, keyFor func(keyID string) (PartnerKey, error)) error {
+	keyID, sig := h.Get(SignatureKeyHeader), h.Get(SignatureHeader)
+	if keyID == "" || sig == "" {
+		return fmt.Errorf("%w: unsigned", ErrBadSignature)
+	}
+	ts, err := strconv.ParseInt(h.Get(SignatureTimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: bad %s", ErrBadSignature, SignatureTimestampHeader)
+	}
+	if skew := now.Sub(time.Unix(ts, 0)); skew > window || skew < -window {
+		return fmt.Errorf("%w: timestamp outside the replay window", ErrBadSignature)
+	}
+
+	key, err := keyFor(keyID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("%w: unknown or expired key %s", ErrBadSignature, keyID)
+	}
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(signPayload(key.Secret, ts, corrID, body)), []byte(sig)) {
+		return fmt.Errorf("%w: signature mismatch", ErrBadSignature)
+	}
+	return nil
+}
+
+// AddPartnerKey stores a new key. A missing secret is generated and a
+// missing ActiveFrom is now.
+func (s *OnboardingService) AddPartnerKey(key PartnerKey) (PartnerKey, error) {
+	if key.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return key, err
+		}
+		key.Secret = hex.EncodeToString(secret)
+	}
+	if key.ActiveFrom.IsZero() {
+		key.ActiveFrom = time.Now()
+	}
+
+	var n int64
+	if err := s.DB.Model(&PartnerKey{}).Where("zone_code = ? AND partner = ? AND key_id = ?",
+		key.ZoneCode, key.Partner, key.KeyID).Count(&n).Error; err != nil {
+		return key, err
+	}
+	if n > 0 {
+		return key, ErrPartnerKeyExists
+	}
+	return key, s.DB.Create(&key).Error
+}
+
+// ListPartnerKeys returns the keys of a zone and partner, either of which
+// may be empty to match all, newest first.
+func (s *OnboardingService) ListPartnerKeys(zoneCode, partner string) ([]PartnerKey, error) {
+	q := s.DB.Order("zone_code, partner, active_from DESC")
+	if zoneCode != "" {
+		q = q.Where("zone_code = ?", zoneCode)
+	}
+	if partner != "" {
+		q = q.Where("partner = ?", partner)
+	}
+	var keys []PartnerKey
+	return keys, q.Find(&keys).Error
+}
+
+// ExpirePartnerKey stops a key being used from at.
+func (s *OnboardingService) ExpirePartnerKey(id uint, at time.Time) (PartnerKey, error) {
+	var key PartnerKey
+	if err := s.DB.First(&key, id).Error; err != nil {
+		return key, err
+	}
+	key.ExpiresAt = &at
+	return key, s.DB.Model(&key).Update("expires_at", at).Error
+}
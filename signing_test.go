@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestCheckSignature(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	body := []byte(`{"status":"SUCCESS"}`)
+	keys := map[string]PartnerKey{"k1": {KeyID: "k1", Secret: "secret-1"}}
+	keyFor := func(keyID string) (PartnerKey, error) {
+		key, ok := keys[keyID]
+		if !ok {
+			return key, gorm.ErrRecordNotFound
+		}
+		return key, nil
+	}
+	signed := func(keyID, secret string, at time.Time, corrID string, body []byte) http.Header {
+		h := http.Header{}
+		h.Set(SignatureKeyHeader, keyID)
+		h.Set(SignatureTimestampHeader, strconv.FormatInt(at.Unix(), 10))
+		h.Set(SignatureHeader, signPayload(secret, at.Unix(), corrID, body))
+		return h
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		body   []byte
+		bad    bool
+	}{
+		{"valid", signed("k1", "secret-1", now, "corr-1", body), body, false},
+		{"valid at the edge of the window", signed("k1", "secret-1", now.Add(-5*time.Minute), "corr-1", body), body, false},
+		{"valid from a fast clock", signed("k1", "secret-1", now.Add(4*time.Minute), "corr-1", body), body, false},
+		{"unsigned", http.Header{}, body, true},
+		{"no key ID", func() http.Header {
+			h := signed("k1", "secret-1", now, "corr-1", body)
+			h.Del(SignatureKeyHeader)
+			return h
+		}(), body, true},
+		{"bad timestamp", func() http.Header {
+			h := signed("k1", "secret-1", now, "corr-1", body)
+			h.Set(SignatureTimestampHeader, "yesterday")
+			return h
+		}(), body, true},
+		{"too old", signed("k1", "secret-1", now.Add(-6*time.Minute), "corr-1", body), body, true},
+		{"too far ahead", signed("k1", "secret-1", now.Add(6*time.Minute), "corr-1", body), body, true},
+		{"unknown key", signed("k2", "secret-1", now, "corr-1", body), body, true},
+		{"wrong secret", signed("k1", "secret-2", now, "corr-1", body), body, true},
+		{"body changed", signed("k1", "secret-1", now, "corr-1", body), []byte(`{"status":"FAILED"}`), true},
+		{"signed for another correlation ID", signed("k1", "secret-1", now, "corr-2", body), body, true},
+		{"timestamp changed", func() http.Header {
+			h := signed("k1", "secret-1", now.Add(-time.Minute), "corr-1", body)
+			h.Set(SignatureTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+			return h
+		}(), body, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSignature("corr-1", tt.header, tt.body, now, 5*time.Minute, keyFor)
+			if tt.bad && !errors.Is(err, ErrBadSignature) {
+				t.Errorf("err = %v, want ErrBadSignature", err)
+			}
+			if !tt.bad && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestCheckSignatureKeyLookupError(t *testing.T) {
+	lookupErr := errors.New("connection refused")
+	h := http.Header{}
+	h.Set(SignatureKeyHeader, "k1")
+	h.Set(SignatureTimestampHeader, "1700000000")
+	h.Set(SignatureHeader, "00")
+
+	err := checkSignature("corr-1", h, nil, time.Unix(1_700_000_000, 0), time.Minute, func(string) (PartnerKey, error) {
+		return PartnerKey{}, lookupErr
+	})
+	if !errors.Is(err, lookupErr) || errors.Is(err, ErrBadSignature) {
+		t.Errorf("err = %v, want the lookup error", err)
+	}
+}
+
+func TestVerifyCallback(t *testing.T) {
+	db := openTestDB(t)
+	s := &OnboardingService{DB: db}
+	now := time.Now()
+	expired := now.Add(-time.Hour)
+
+	for _, zone := range []ZoneConfig{{ZoneCode: "NORTH"}, {ZoneCode: "EAST", AllowUnsigned: true}} {
+		if err := db.Create(&zone).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, zone := range []string{"NORTH", "EAST"} {
+		caf := Caf{CafRefNo: "CAF-SIG-" + zone, ZoneCode: zone}
+		if err := db.Create(&caf).Error; err != nil {
+			t.Fatal(err)
+		}
+		// Reversals are signed with the key of the step they undo
+		for _, target := range []string{"PREACT", "PREACT_ROLLBACK"} {
+			row := IntegrationOutbox{CafID: caf.ID, Target: target, CorrelationID: zone + "-" + target, Status: "SENT"}
+			if err := db.Create(&row).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+		keys := []PartnerKey{
+			{ZoneCode: zone, Partner: "PREACT", KeyID: "current", Secret: "secret-" + strconv.Itoa(i), ActiveFrom: now},
+			{ZoneCode: zone, Partner: "PREACT", KeyID: "retired", Secret: "old-" + strconv.Itoa(i), ActiveFrom: expired, ExpiresAt: &expired},
+		}
+		if err := db.Create(&keys).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body := []byte(`{"status":"SUCCESS"}`)
+	signed := func(keyID, secret, corrID string) http.Header {
+		h := http.Header{}
+		h.Set(SignatureKeyHeader, keyID)
+		h.Set(SignatureTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+		h.Set(SignatureHeader, signPayload(secret, now.Unix(), corrID, body))
+		return h
+	}
+
+	tests := []struct {
+		name    string
+		corrID  string
+		header  http.Header
+		wantErr error
+	}{
+		{"signed", "NORTH-PREACT", signed("current", "secret-0", "NORTH-PREACT"), nil},
+		{"reversal signed with the step's key", "NORTH-PREACT_ROLLBACK", signed("current", "secret-0", "NORTH-PREACT_ROLLBACK"), nil},
+		{"unsigned", "NORTH-PREACT", http.Header{}, ErrBadSignature},
+		{"expired key", "NORTH-PREACT", signed("retired", "old-0", "NORTH-PREACT"), ErrBadSignature},
+		{"another zone's key", "NORTH-PREACT", signed("current", "secret-1", "NORTH-PREACT"), ErrBadSignature},
+		{"unsigned in a zone allowing it", "EAST-PREACT", http.Header{}, nil},
+		{"badly signed in a zone allowing unsigned", "EAST-PREACT", signed("current", "secret-0", "EAST-PREACT"), ErrBadSignature},
+		{"unknown correlation ID", "NORTH-TV", signed("current", "secret-0", "NORTH-TV"), ErrUnknownCorrelation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.verifyCallback(tt.corrID, tt.header, body, now, defaultReplayWindow)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}